@@ -1,18 +1,17 @@
 package discovery
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/hex"
+	"context"
 	"errors"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/tinygoprogs/netmess/util"
 	"io/ioutil"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -32,57 +31,48 @@ func init() {
 	}
 }
 
-// Holding a thread-save callback list.
-type listenerMap struct {
-	lock sync.Mutex
-	// TODO: the key here (aka reason) should be a 'type ListenerReason' with a
-	// String() method and a 'class' like ReplyListener, InteractiveListener, ??
-	funcs map[string]func(gopacket.Packet)
-}
-
-func newListenerMap() *listenerMap {
-	return &listenerMap{funcs: make(map[string]func(gopacket.Packet), 4)}
-}
-func (m *listenerMap) Add(desc string, f func(gopacket.Packet)) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	if _, exists := m.funcs[desc]; exists {
-		return errors.New("exists already")
-	}
-	m.funcs[desc] = f
-	return nil
-}
-func (m *listenerMap) Remove(desc string) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	delete(m.funcs, desc)
-}
-
 type Network struct {
 	Dev       *net.Interface
 	Localhost Host
 	hosts     *HostMap
-	handle    *pcap.Handle
+	resolver  *arpResolver
 	Listeners *listenerMap
+	// where packets come from and go to
+	pio util.PacketIO
+	// subnets of Dev, see onLink
+	subnets []*net.IPNet
+	closed  chan struct{}
+	done    chan struct{}
+	// see Record
+	recordLock sync.RWMutex
+	recorder   *Recorder
 }
 
+// Hosts not seen for HostTTL are forgotten, 0 keeps them forever.
+var HostTTL = time.Hour
+
 // Network scope is defined by device.
 // Should defer Network.Close().
 func NewNetwork(dev string) (*Network, error) {
 	device, exists := Ifs[dev]
 	if !exists {
-		return nil, errors.New("no such interface")
+		// created after init, e.g. a veth
+		ifi, err := net.InterfaceByName(dev)
+		if err != nil {
+			return nil, errors.New("no such interface")
+		}
+		device = *ifi
 	}
 
-	handle, err := pcap.OpenLive(dev, 0xffff, true, pcap.BlockForever)
+	pio, err := util.OpenLive(dev)
 	if err != nil {
-		handle, err = pcap.OpenLive(dev, 0xffff, false, pcap.BlockForever)
-		if err == nil {
-			log.Printf("non promiscuous pcap on %s: %v", dev, err)
+		// no libpcap, try without
+		af, aferr := util.OpenAFPacket(dev)
+		if aferr != nil {
+			log.Printf("pcap: %v, AF_PACKET: %v", err, aferr)
+			return nil, errors.New("cannot play with that interface")
 		}
-	}
-	if err != nil {
-		return nil, errors.New("cannot play with that interface")
+		pio = af
 	}
 
 	var ip net.IP
@@ -97,34 +87,127 @@ func NewNetwork(dev string) (*Network, error) {
 			}
 		}
 	}
+	localhost := Host{Addr: ip, Mac: device.HardwareAddr}
+	var subnets []*net.IPNet
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			subnets = append(subnets, ipnet)
+			localhost.AddAddr(ipnet.IP)
+		}
+	}
+
+	network := newNetwork(pio, &device, localhost, subnets)
+	// immediately start package dispatcher
+	go network.dispatch(false)
+	go network.expire_loop()
+
+	return network, nil
+}
+
+// Network on top of any PacketIO, e.g. a util.Hub port in tests. We are
+// <localhost> on device <name>, with addresses <addrs> (like the ones of a
+// net.Interface, e.g. 10.0.0.2/24). Should defer Network.Close().
+func NewNetworkIO(pio util.PacketIO, name string, localhost Host, addrs ...*net.IPNet) *Network {
+	for _, ipnet := range addrs {
+		localhost.AddAddr(ipnet.IP)
+	}
+	dev := &net.Interface{Name: name, HardwareAddr: localhost.Mac}
+	network := newNetwork(pio, dev, localhost, addrs)
+	go network.dispatch(false)
+	go network.expire_loop()
+	return network
+}
 
-	network := Network{
-		Dev:       &device,
+func newNetwork(pio util.PacketIO, dev *net.Interface, localhost Host, subnets []*net.IPNet) *Network {
+	network := &Network{
+		Dev:       dev,
 		hosts:     NewHostMap(),
-		Localhost: Host{ip, device.HardwareAddr},
-		handle:    handle,
+		resolver:  newARPResolver(),
+		Localhost: localhost,
 		Listeners: newListenerMap(),
+		pio:       pio,
+		subnets:   subnets,
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
 	}
+	network.Listeners.Add(passiveReason, network.learn)
+	return network
+}
 
-	// immediately start package dispatcher
-	go func() {
-		src := gopacket.NewPacketSource(handle, handle.LinkType())
-		for packet := range src.Packets() {
-			wg := sync.WaitGroup{}
-			network.Listeners.lock.Lock()
-			for _, listener := range network.Listeners.funcs {
-				wg.Add(1)
-				go func() {
-					listener(packet)
-					wg.Done()
-				}()
+// Analyse the pcap or pcapng <file> instead of live traffic. Hosts in
+// <subnets> (CIDRs) are considered on-link, private addresses if none are
+// given. With <pace> packets are dispatched as fast as they were captured,
+// otherwise as fast as possible. Nothing can be sent. Done is closed after the
+// last packet.
+func NewOfflineNetwork(file string, pace bool, subnets ...string) (*Network, error) {
+	var nets []*net.IPNet
+	for _, cidr := range subnets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+
+	pio, err := util.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	network := newNetwork(pio, &net.Interface{Name: file}, Host{}, nets)
+	// nothing is lost by waiting for slow listeners
+	network.Listeners.lossless = true
+	go network.dispatch(pace)
+
+	return network, nil
+}
+
+// Hand every packet to the listeners' queues. With <pace>, keep the timing of
+// the capture.
+func (n *Network) dispatch(pace bool) {
+	defer close(n.done)
+	var first, start time.Time
+	src := gopacket.NewPacketSource(n.pio, n.pio.LinkType())
+	for packet := range src.Packets() {
+		if pace {
+			ts := packet.Metadata().Timestamp
+			if first.IsZero() {
+				first, start = ts, time.Now()
+			}
+			timer := time.NewTimer(time.Until(start.Add(ts.Sub(first))))
+			select {
+			case <-timer.C:
+			case <-n.closed:
+				timer.Stop()
+				return
 			}
-			network.Listeners.lock.Unlock()
-			wg.Wait()
 		}
-	}()
+		n.record(packet.Metadata().CaptureInfo, packet.Data(), false)
+		n.Listeners.dispatch(packet, n.closed)
+	}
+	n.Listeners.close(n.closed)
+}
 
-	return &network, nil
+// Closed once there are no more packets, i.e. at the end of an offline
+// capture.
+func (n *Network) Done() <-chan struct{} {
+	return n.done
+}
+
+func (n *Network) expire_loop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if HostTTL > 0 {
+				for _, h := range n.hosts.Expire(HostTTL) {
+					log.Printf("[+] expired %s", h.String())
+				}
+			}
+		case <-n.closed:
+			return
+		}
+	}
 }
 
 // Apply information from "/proc/net/arp".
@@ -148,78 +231,69 @@ func (n *Network) ApplyProcNetARP() {
 		if err != nil {
 			continue
 		}
-		n.hosts.Update(&Host{net.ParseIP(cols[0]), mac})
+		n.hosts.Update(&Host{Addr: net.ParseIP(cols[0]), Mac: mac})
 	}
 }
 
-// return the Host that the OS thinks is the current gateway
-func (n *Network) Gateway() (*Host, error) {
-	var host *Host
-	tmp, err := ioutil.ReadFile("/proc/net/route")
-	if err != nil {
-		return nil, err
-	}
-	content := strings.Split(string(tmp), "\n")
-	for _, line := range content[1:] {
-		cols := strings.Fields(line)
-		if len(cols) != 11 {
-			continue
+// return the IPv4 subnet Localhost is part of
+func (n *Network) Subnet() (*net.IPNet, error) {
+	for _, ipnet := range n.subnets {
+		if ipnet.IP.Equal(n.Localhost.Addr) {
+			return &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}, nil
 		}
-		if cols[0] != n.Dev.Name {
-			continue
-		}
-		if cols[1] != "00000000" {
-			continue
-		} // dst
-		if cols[7] != "00000000" {
-			continue
-		} // mask
-		// wow this is 'ugly'
-		ip_rev, err := hex.DecodeString(cols[2])
-		if err != nil {
-			return nil, err
-		}
-		ip32 := binary.BigEndian.Uint32(ip_rev)
-		ip_bytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(ip_bytes, ip32)
-		host.Addr = ip_bytes
 	}
-	return host, nil
+	return nil, errors.New("no subnet for " + n.Localhost.Addr.String())
 }
 
-// Closes the underlying pcap handle.
-func (n *Network) Close() {
-	if n.handle != nil {
-		n.handle.Close()
-	}
+// All hosts seen so far.
+func (n *Network) Hosts() []Host {
+	return n.hosts.Hosts()
 }
 
-// Return Host information for <ip> on the current Network. If the <ip> is
-// unknown we try to find it using ARP.
-func (n *Network) GetHostByIP(ip string) (*Host, error) {
-	if host := n.hosts.GetIP(ip); host != nil {
-		return host, nil
-	}
-	tmp := net.ParseIP(ip)
-	if tmp == nil {
-		return nil, errors.New("parsing ip")
-	}
-	target := tmp.To4()
-	if target == nil {
-		return nil, errors.New("only ipv4")
+// The hosts of this Network, e.g. to Subscribe to changes.
+func (n *Network) HostMap() *HostMap {
+	return n.hosts
+}
+
+// Closes the underlying PacketIO and stops expiring hosts.
+func (n *Network) Close() {
+	select {
+	case <-n.closed:
+	default:
+		close(n.closed)
 	}
-	log.Printf("[+] requesting %v", target)
+	n.pio.Close()
+}
 
+// Serialize <l> (fixing lengths and checksums) and inject it on the wire.
+func (n *Network) Send(l ...gopacket.SerializableLayer) error {
 	opts := gopacket.SerializeOptions{
-		// XXX maybe add some options, e.g.:
-		//FixLengths:       true,
-		//ComputeChecksums: true,
+		FixLengths:       true,
+		ComputeChecksums: true,
 	}
 	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return err
+	}
+	n.record(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}, buf.Bytes(), true)
+	return n.pio.WritePacketData(buf.Bytes())
+}
+
+// Return Host information for <ip> on the current Network. If the <ip> is
+// unknown we try to find it using ARP, see ResolveIP.
+func (n *Network) GetHostByIP(ip string) (*Host, error) {
+	return n.ResolveIP(context.Background(), ip)
+}
 
+// Broadcast an ARP request for <target>.
+func (n *Network) requestARP(target net.IP) error {
 	leth := layers.Ethernet{
 		SrcMAC:       n.Localhost.Mac,
-		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		DstMAC:       layers.EthernetBroadcast,
 		EthernetType: layers.EthernetTypeARP,
 	}
 	larp := layers.ARP{
@@ -229,37 +303,9 @@ func (n *Network) GetHostByIP(ip string) (*Host, error) {
 		ProtAddressSize:   4,
 		Operation:         layers.ARPRequest,
 		SourceHwAddress:   n.Localhost.Mac,
-		SourceProtAddress: n.Localhost.Addr,
+		SourceProtAddress: n.Localhost.Addr.To4(),
 		DstHwAddress:      []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-		DstProtAddress:    target,
+		DstProtAddress:    target.To4(),
 	}
-
-	gopacket.SerializeLayers(buf, opts, &leth, &larp)
-	err := n.handle.WritePacketData(buf.Bytes())
-	if err != nil {
-		log.Printf("write err: %v", err)
-	}
-
-	// XXX: if the reply gets lost.. maybe delete all listeners from time to time?
-	done := make(chan bool, 1)
-	reason := "awaiting ARP reply"
-	n.Listeners.Add(reason, func(pkt gopacket.Packet) {
-		arplayer := pkt.Layer(layers.LayerTypeARP)
-		if arplayer == nil {
-			return
-		}
-		arp := arplayer.(*layers.ARP)
-		if arp.Operation != layers.ARPReply ||
-			!bytes.Equal(arp.SourceProtAddress, target) {
-			return
-		}
-		n.hosts.Update(&Host{target, arp.SourceHwAddress})
-		done <- true
-	})
-
-	<-done
-	n.Listeners.Remove(reason)
-	log.Printf("[+] %s: done", reason)
-
-	return n.hosts.GetIP(ip), nil
+	return n.Send(&leth, &larp)
 }
@@ -0,0 +1,261 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What we know about a Host besides its addresses, learned passively.
+type HostMeta struct {
+	// OUI vendor, empty if unknown
+	Vendor string
+	// locally administered, i.e. most likely randomized, MAC
+	RandomMac bool
+	// DHCP options 12, 60 and 55 of the last request
+	Hostname     string
+	VendorClass  string
+	ParamRequest []byte
+	// initial TTL (hop limit) guessed from the last packet, e.g. 64 or 128
+	TTL uint8
+	// TCP SYN signature "<window>:<mss>:<options>", e.g.
+	// "64240:1460:mss,sok,ts,nop,ws"
+	SYN string
+	// OS guess from SYN and TTL
+	OS string
+	// Stable identity surviving IP changes and, if the host sent a DHCP
+	// hostname, MAC randomization: hosts sharing an ID are the same machine,
+	// see HostMap.Identity. Empty while unknown.
+	ID string
+}
+
+// Take everything <o> knows, then refresh Vendor and ID for <mac>.
+func (m *HostMeta) merge(o *HostMeta, mac net.HardwareAddr) {
+	if o.Hostname != "" {
+		m.Hostname = o.Hostname
+	}
+	if o.VendorClass != "" {
+		m.VendorClass = o.VendorClass
+	}
+	if len(o.ParamRequest) > 0 {
+		m.ParamRequest = append([]byte(nil), o.ParamRequest...)
+	}
+	if o.TTL != 0 {
+		m.TTL = o.TTL
+	}
+	if o.SYN != "" {
+		m.SYN = o.SYN
+	}
+	if o.OS != "" {
+		m.OS = o.OS
+	} else if m.SYN == "" {
+		m.OS = guessOS(m.TTL, "")
+	}
+	if len(mac) == 6 {
+		m.RandomMac = mac[0]&0x02 != 0
+		if m.Vendor == "" && !m.RandomMac {
+			m.Vendor = LookupOUI(mac)
+		}
+	}
+	if m.Hostname != "" {
+		sum := sha1.Sum([]byte(m.Hostname + "\x00" + m.VendorClass + "\x00" +
+			string(m.ParamRequest)))
+		m.ID = "dhcp-" + hex.EncodeToString(sum[:8])
+	} else if m.ID == "" && len(mac) == 6 && !m.RandomMac {
+		m.ID = "mac-" + mac.String()
+	}
+}
+
+// Fill in HostMeta of on-link senders from DHCP requests, TTLs and TCP SYNs.
+func (n *Network) fingerprint(pkt gopacket.Packet, eth *layers.Ethernet, seen time.Time) {
+	if l := pkt.Layer(layers.LayerTypeDHCPv4); l != nil {
+		dhcp := l.(*layers.DHCPv4)
+		if dhcp.Operation == layers.DHCPOpRequest && len(dhcp.ClientHWAddr) == 6 {
+			var meta HostMeta
+			for _, o := range dhcp.Options {
+				switch o.Type {
+				case layers.DHCPOptHostname:
+					meta.Hostname = string(o.Data)
+				case layers.DHCPOptClassID:
+					meta.VendorClass = string(o.Data)
+				case layers.DHCPOptParamsRequest:
+					meta.ParamRequest = append([]byte(nil), o.Data...)
+				}
+			}
+			n.hosts.Update(&Host{Mac: dhcp.ClientHWAddr, Meta: meta, LastSeen: seen})
+		}
+	}
+
+	var src net.IP
+	var meta HostMeta
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, meta.TTL = ip.SrcIP, initialTTL(ip.TTL)
+	case *layers.IPv6:
+		src, meta.TTL = ip.SrcIP, initialTTL(ip.HopLimit)
+	default:
+		return
+	}
+	if src.IsUnspecified() || !n.onLink(src) {
+		// routed, TTL and MAC belong to different hosts
+		return
+	}
+	if l := pkt.Layer(layers.LayerTypeTCP); l != nil {
+		tcp := l.(*layers.TCP)
+		if tcp.SYN && !tcp.ACK {
+			mss, opts := synOptions(tcp)
+			meta.SYN = fmt.Sprintf("%d:%d:%s", tcp.Window, mss, opts)
+			meta.OS = guessOS(meta.TTL, opts)
+		}
+	}
+	n.hosts.Update(&Host{Mac: eth.SrcMAC, Meta: meta, LastSeen: seen})
+}
+
+// MSS and option layout of a SYN, in p0f notation
+func synOptions(tcp *layers.TCP) (uint16, string) {
+	var mss uint16
+	names := make([]string, 0, len(tcp.Options))
+	for _, o := range tcp.Options {
+		switch o.OptionType {
+		case layers.TCPOptionKindEndList:
+			names = append(names, "eol")
+		case layers.TCPOptionKindNop:
+			names = append(names, "nop")
+		case layers.TCPOptionKindMSS:
+			if len(o.OptionData) == 2 {
+				mss = uint16(o.OptionData[0])<<8 | uint16(o.OptionData[1])
+			}
+			names = append(names, "mss")
+		case layers.TCPOptionKindWindowScale:
+			names = append(names, "ws")
+		case layers.TCPOptionKindSACKPermitted:
+			names = append(names, "sok")
+		case layers.TCPOptionKindTimestamps:
+			names = append(names, "ts")
+		default:
+			names = append(names, fmt.Sprintf("?%d", o.OptionType))
+		}
+	}
+	return mss, strings.Join(names, ",")
+}
+
+// the common initial TTL an observed TTL was decremented from
+func initialTTL(ttl uint8) uint8 {
+	for _, initial := range []uint8{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+// Passive OS guess, TCP option layouts are more telling than TTLs.
+func guessOS(ttl uint8, synOpts string) string {
+	switch {
+	case strings.HasPrefix(synOpts, "mss,sok,ts,nop,ws"):
+		return "Linux"
+	case strings.HasPrefix(synOpts, "mss,nop,ws,nop,nop,ts,sok,eol"):
+		return "macOS/iOS"
+	case strings.HasPrefix(synOpts, "mss,nop,ws,nop,nop,sok"):
+		return "Windows"
+	}
+	switch ttl {
+	case 64:
+		return "Unix"
+	case 128:
+		return "Windows"
+	case 255:
+		return "network device"
+	}
+	return ""
+}
+
+var (
+	ouiLock sync.RWMutex
+	// a few common OUIs, see LoadOUI for the full list
+	ouiVendors = map[string]string{
+		"00:00:0c": "Cisco",
+		"00:03:93": "Apple",
+		"00:0c:29": "VMware",
+		"00:15:5d": "Microsoft Hyper-V",
+		"00:16:3e": "Xen",
+		"00:1a:11": "Google",
+		"00:50:56": "VMware",
+		"08:00:27": "VirtualBox",
+		"18:e8:29": "Ubiquiti",
+		"28:cf:e9": "Apple",
+		"3c:5a:b4": "Google",
+		"52:54:00": "QEMU",
+		"b8:27:eb": "Raspberry Pi",
+		"dc:a6:32": "Raspberry Pi",
+		"f0:9f:c2": "Ubiquiti",
+		"fc:fb:fb": "Cisco",
+	}
+)
+
+// Vendor of <mac>, empty if unknown.
+func LookupOUI(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	ouiLock.RLock()
+	defer ouiLock.RUnlock()
+	return ouiVendors[mac[:3].String()]
+}
+
+// Add vendors from the IEEE list (oui.txt), i.e. lines like
+//
+//	00-00-0C   (hex)		Cisco Systems, Inc
+func LoadOUI(r io.Reader) error {
+	vendors := make(map[string]string, 1<<15)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "(hex)")
+		if i < 0 {
+			continue
+		}
+		prefix, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(line[:i]), "-", ""))
+		if err != nil || len(prefix) != 3 {
+			continue
+		}
+		vendors[net.HardwareAddr(prefix).String()] = strings.TrimSpace(line[i+len("(hex)"):])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	ouiLock.Lock()
+	defer ouiLock.Unlock()
+	for k, v := range vendors {
+		ouiVendors[k] = v
+	}
+	return nil
+}
+
+// LoadOUI from a file.
+func LoadOUIFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return LoadOUI(f)
+}
+
+// Whether <o> looks like the same machine as h.
+func (h *Host) SameAs(o *Host) bool {
+	if bytes.Equal(h.Mac, o.Mac) {
+		return true
+	}
+	return h.Meta.ID != "" && h.Meta.ID == o.Meta.ID
+}
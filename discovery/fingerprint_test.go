@@ -0,0 +1,43 @@
+package discovery
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHostMetaIdentity(t *testing.T) {
+	if err := LoadOUI(strings.NewReader(`
+OUI/MA-L                                                    Organization
+A8-BB-CC   (hex)		Example Corp
+a8bbcc     (base 16)		Example Corp
+`)); err != nil {
+		t.Fatal(err)
+	}
+	burned, _ := net.ParseMAC("a8:bb:cc:00:00:01")
+	random1, _ := net.ParseMAC("da:00:00:00:00:01")
+	random2, _ := net.ParseMAC("da:00:00:00:00:02")
+	dhcp := HostMeta{Hostname: "laptop", ParamRequest: []byte{1, 3, 6, 15}}
+
+	hm := NewHostMap()
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.2"), Mac: burned})
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.3"), Mac: random1, Meta: dhcp})
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.4"), Mac: random2})
+	hm.Update(&Host{Mac: random2, Meta: dhcp})
+	hm.Update(&Host{Mac: random2, Meta: HostMeta{TTL: 128}})
+
+	h := hm.GetIP("10.0.0.2")
+	if h.Meta.Vendor != "Example Corp" || h.Meta.RandomMac || h.Meta.ID != "mac-"+burned.String() {
+		t.Errorf("burned-in MAC: %+v", h.Meta)
+	}
+	h = hm.GetIP("10.0.0.4")
+	if !h.Meta.RandomMac || h.Meta.Hostname != "laptop" || h.Meta.OS != "Windows" {
+		t.Errorf("random MAC: %+v", h.Meta)
+	}
+	if same := hm.Identity(h.Meta.ID); len(same) != 2 {
+		t.Errorf("identity %s: %d hosts, want 2", h.Meta.ID, len(same))
+	}
+	if !h.SameAs(hm.GetIP("10.0.0.3")) || h.SameAs(hm.GetIP("10.0.0.2")) {
+		t.Error("SameAs")
+	}
+}
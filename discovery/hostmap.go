@@ -1,74 +1,350 @@
 package discovery
 
 import (
-	"bytes"
+	"fmt"
 	"net"
+	"reflect"
+	"sync"
+	"time"
 )
 
-/*
-TODO: Host fingerprinting. Hosts might change mac + ip.
-type HostMeta struct {
-    ;
-}
-*/
-
 // used by make() calls
 const init_size = 20
 
 type Host struct {
+	// primary address, the first IPv4 one if there is any
 	Addr net.IP
 	Mac  net.HardwareAddr
-	//Meta HostMeta TODO
+	// all IPv4 and IPv6 addresses of Mac, including Addr
+	Addrs []net.IP
+	// when the Host was first and last seen on the wire, set by Update
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// fingerprint, see HostMeta
+	Meta HostMeta
 }
 
 func (h *Host) String() string {
 	return h.Mac.String() + " @ " + h.Addr.String()
 }
 
+// Whether <ip> is one of the addresses of h.
+func (h *Host) HasAddr(ip net.IP) bool {
+	if h.Addr.Equal(ip) {
+		return true
+	}
+	for _, a := range h.Addrs {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add <ip> to Addrs, making it the primary address if it is the first IPv4
+// one. Returns false if it was known already.
+func (h *Host) AddAddr(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, a := range h.Addrs {
+		if a.Equal(ip) {
+			return false
+		}
+	}
+	h.Addrs = append(h.Addrs, ip)
+	if h.Addr == nil || (h.Addr.To4() == nil && ip.To4() != nil) {
+		h.Addr = ip
+	}
+	return true
+}
+
+// Remove <ip> from Addrs, picking a new primary address if needed.
+func (h *Host) dropAddr(ip net.IP) {
+	addrs := h.Addrs[:0]
+	for _, a := range h.Addrs {
+		if !a.Equal(ip) {
+			addrs = append(addrs, a)
+		}
+	}
+	h.Addrs = addrs
+	if h.Addr.Equal(ip) {
+		h.Addr = nil
+		for _, a := range h.Addrs {
+			if h.Addr == nil || (h.Addr.To4() == nil && a.To4() != nil) {
+				h.Addr = a
+			}
+		}
+	}
+}
+
+// All IPv6 addresses of h.
+func (h *Host) IPv6() []net.IP {
+	var ips []net.IP
+	for _, a := range h.Addrs {
+		if a.To4() == nil {
+			ips = append(ips, a)
+		}
+	}
+	return ips
+}
+
+type HostEventKind uint8
+
+const (
+	HostAdded HostEventKind = iota
+	// new address or fingerprint, LastSeen alone doesn't count
+	HostChanged
+	HostRemoved
+)
+
+func (k HostEventKind) String() string {
+	switch k {
+	case HostAdded:
+		return "added"
+	case HostChanged:
+		return "changed"
+	case HostRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("HostEventKind(%d)", uint8(k))
+}
+
+// A change of a HostMap, Host is a copy of the (removed) host.
+type HostEvent struct {
+	Kind HostEventKind
+	Host Host
+}
+
+// Known hosts, one per MAC, reachable by any of their addresses. Safe for
+// concurrent use; all getters return copies.
 type HostMap struct {
+	lock   sync.RWMutex
 	ipMap  map[string]*Host
 	macMap map[string]*Host
-	hosts  []Host
+	subs   map[chan HostEvent]bool
+	// MACs loaded from a Store and not seen since, never expired
+	stored map[string]bool
 }
 
 func NewHostMap() *HostMap {
 	return &HostMap{
 		ipMap:  make(map[string]*Host, init_size),
 		macMap: make(map[string]*Host, init_size),
-		hosts:  make([]Host, 0, init_size),
+		subs:   make(map[chan HostEvent]bool, 4),
+		stored: make(map[string]bool, init_size),
 	}
 }
 
-func (hm *HostMap) knownMac(h *Host) (*Host, bool) {
-	exists := false
-	var rhost *Host
-	for _, box := range hm.hosts {
-		if bytes.Equal(box.Mac, h.Mac) {
-			exists = true
-			rhost = &box
-			break
-		}
-	}
-	return rhost, exists
+// deep copy, hosts in the map are modified by Update
+func (h *Host) copy() Host {
+	cp := *h
+	cp.Addrs = append([]net.IP(nil), h.Addrs...)
+	cp.Meta.ParamRequest = append([]byte(nil), h.Meta.ParamRequest...)
+	return cp
 }
 
+// Add or refresh <h>, merging its addresses into the Host with the same MAC.
+// An address moving to another MAC is removed from the old one. A zero
+// LastSeen means now. Hosts without a MAC are ignored, as they would all be
+// merged into one.
 func (hm *HostMap) Update(h *Host) {
-	if hst, known := hm.knownMac(h); known {
-		hst.Mac = h.Mac
-		h = hst // don't let a new pointer escape here
-	} else {
-		hm.hosts = append(hm.hosts, *h)
+	if len(h.Mac) == 0 {
+		return
 	}
-	hm.ipMap[h.Addr.String()] = h
-	hm.macMap[h.Mac.String()] = h
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	hm.update(h)
+	delete(hm.stored, h.Mac.String())
 }
 
+// Update with a Host loaded from a Store: kept, no matter how old its
+// LastSeen is, until it is seen again.
+func (hm *HostMap) restore(h *Host) {
+	if len(h.Mac) == 0 {
+		return
+	}
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	hm.update(h)
+	hm.stored[h.Mac.String()] = true
+}
+
+// called with lock held
+func (hm *HostMap) update(h *Host) {
+	if h.LastSeen.IsZero() {
+		h.LastSeen = time.Now()
+	}
+	hst, known := hm.macMap[h.Mac.String()]
+	if !known {
+		// don't let a new pointer escape here
+		hst = &Host{
+			Mac:       append(net.HardwareAddr(nil), h.Mac...),
+			FirstSeen: h.FirstSeen,
+		}
+		if hst.FirstSeen.IsZero() {
+			hst.FirstSeen = h.LastSeen
+		}
+		hm.macMap[h.Mac.String()] = hst
+	}
+	if h.LastSeen.After(hst.LastSeen) {
+		hst.LastSeen = h.LastSeen
+	}
+	meta := hst.Meta
+	hst.Meta.merge(&h.Meta, hst.Mac)
+	changed := !reflect.DeepEqual(meta, hst.Meta)
+
+	addrs := h.Addrs
+	if h.Addr != nil {
+		addrs = append([]net.IP{h.Addr}, addrs...)
+	}
+	for _, ip := range addrs {
+		if ip == nil || !hst.AddAddr(ip) {
+			continue
+		}
+		changed = true
+		key := hst.Addrs[len(hst.Addrs)-1].String()
+		if old, exists := hm.ipMap[key]; exists && old != hst {
+			old.dropAddr(ip)
+			hm.notify(HostChanged, old)
+		}
+		hm.ipMap[key] = hst
+	}
+
+	if !known {
+		hm.notify(HostAdded, hst)
+	} else if changed {
+		hm.notify(HostChanged, hst)
+	}
+}
+
+// Forget the host with the MAC of <h>, or the one owning h.Addr if h.Mac is
+// not set.
 func (hm *HostMap) Remove(h Host) {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	hst, exists := hm.macMap[h.Mac.String()]
+	if h.Mac == nil {
+		hst, exists = hm.ipMap[h.Addr.String()]
+	}
+	if exists {
+		hm.remove(hst)
+	}
+}
+
+func (hm *HostMap) remove(hst *Host) {
+	delete(hm.macMap, hst.Mac.String())
+	delete(hm.stored, hst.Mac.String())
+	for _, ip := range hst.Addrs {
+		if hm.ipMap[ip.String()] == hst {
+			delete(hm.ipMap, ip.String())
+		}
+	}
+	hm.notify(HostRemoved, hst)
+}
+
+// Remove hosts not seen for <maxAge> and return them. Hosts loaded from a
+// Store stay until seen again.
+func (hm *HostMap) Expire(maxAge time.Duration) []Host {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	var expired []Host
+	deadline := time.Now().Add(-maxAge)
+	for _, hst := range hm.macMap {
+		if hst.LastSeen.Before(deadline) && !hm.stored[hst.Mac.String()] {
+			expired = append(expired, hst.copy())
+			hm.remove(hst)
+		}
+	}
+	return expired
 }
 
 func (hm *HostMap) GetIP(ip string) *Host {
+	hm.lock.RLock()
+	defer hm.lock.RUnlock()
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
 	if val, exist := hm.ipMap[ip]; exist {
-		return val
+		cp := val.copy()
+		return &cp
 	}
 	return nil
 }
+
+// Host with <mac>, nil if unknown.
+func (hm *HostMap) GetMac(mac net.HardwareAddr) *Host {
+	hm.lock.RLock()
+	defer hm.lock.RUnlock()
+	if val, exist := hm.macMap[mac.String()]; exist {
+		cp := val.copy()
+		return &cp
+	}
+	return nil
+}
+
+// Copy of all known hosts, one per MAC.
+func (hm *HostMap) Hosts() []Host {
+	hm.lock.RLock()
+	defer hm.lock.RUnlock()
+	all := make([]Host, 0, len(hm.macMap))
+	for _, h := range hm.macMap {
+		all = append(all, h.copy())
+	}
+	return all
+}
+
+// Call <f> for a snapshot of all hosts until it returns false. <f> may use
+// the HostMap.
+func (hm *HostMap) Each(f func(Host) bool) {
+	for _, h := range hm.Hosts() {
+		if !f(h) {
+			return
+		}
+	}
+}
+
+// All hosts sharing the identity <id> (HostMeta.ID), i.e. the MACs a host
+// used over time.
+func (hm *HostMap) Identity(id string) []Host {
+	var same []Host
+	hm.Each(func(h Host) bool {
+		if h.Meta.ID == id {
+			same = append(same, h)
+		}
+		return true
+	})
+	return same
+}
+
+// Receive every HostEvent from now on, until the returned cancel func is
+// called. Events are dropped if the channel (buffered, <size>) is full.
+func (hm *HostMap) Subscribe(size int) (<-chan HostEvent, func()) {
+	c := make(chan HostEvent, size)
+	hm.lock.Lock()
+	hm.subs[c] = true
+	hm.lock.Unlock()
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			hm.lock.Lock()
+			delete(hm.subs, c)
+			hm.lock.Unlock()
+			close(c)
+		})
+	}
+}
+
+// called with lock held
+func (hm *HostMap) notify(kind HostEventKind, h *Host) {
+	if len(hm.subs) == 0 {
+		return
+	}
+	ev := HostEvent{Kind: kind, Host: h.copy()}
+	for c := range hm.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostMap(t *testing.T) {
+	hm := NewHostMap()
+	events, cancel := hm.Subscribe(16)
+	defer cancel()
+
+	a, _ := net.ParseMAC("02:00:00:00:00:0a")
+	b, _ := net.ParseMAC("02:00:00:00:00:0b")
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.1"), Mac: a})
+	hm.Update(&Host{Addr: net.ParseIP("fe80::a"), Mac: a})
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.1"), Mac: a})
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.2"), Mac: b,
+		LastSeen: time.Now().Add(-time.Hour)})
+
+	h := hm.GetMac(a)
+	if h == nil || len(h.Addrs) != 2 || !h.Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("GetMac: %+v", h)
+	}
+	if h := hm.GetIP("FE80::A"); h == nil || h.Mac.String() != a.String() {
+		t.Errorf("GetIP: %+v", h)
+	}
+
+	// 10.0.0.1 moves to b
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.1"), Mac: b,
+		LastSeen: time.Now().Add(-time.Hour)})
+	if h := hm.GetMac(a); h.HasAddr(net.ParseIP("10.0.0.1")) || h.Addr.To4() != nil {
+		t.Errorf("address not moved: %+v", h)
+	}
+
+	if expired := hm.Expire(time.Minute); len(expired) != 1 || expired[0].Mac.String() != b.String() {
+		t.Errorf("Expire: %v", expired)
+	}
+	if hm.GetIP("10.0.0.2") != nil {
+		t.Error("expired host still known")
+	}
+	hm.Remove(Host{Addr: net.ParseIP("fe80::a")})
+	if len(hm.Hosts()) != 0 {
+		t.Errorf("Remove: %v", hm.Hosts())
+	}
+
+	want := []HostEventKind{HostAdded, HostChanged, HostAdded,
+		HostChanged, HostChanged, HostRemoved, HostRemoved}
+	for i, kind := range want {
+		select {
+		case ev := <-events:
+			if ev.Kind != kind {
+				t.Errorf("event %d: %v %s, want %v", i, ev.Kind, ev.Host.String(), kind)
+			}
+		default:
+			t.Fatalf("event %d: none, want %v", i, kind)
+		}
+	}
+}
+
+func TestHostMapNoMac(t *testing.T) {
+	hm := NewHostMap()
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.1")})
+	hm.Update(&Host{Addr: net.ParseIP("10.0.0.2"), Mac: net.HardwareAddr{}})
+	if hosts := hm.Hosts(); len(hosts) != 0 {
+		t.Errorf("hosts without MAC: %v", hosts)
+	}
+	if hm.GetIP("10.0.0.1") != nil {
+		t.Error("GetIP of a host without MAC")
+	}
+}
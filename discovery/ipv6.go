@@ -0,0 +1,225 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// how long ScanIPv6 waits for answers, unless the context is done earlier
+	NDPScanTimeout = time.Second * 3
+
+	// ff02::1, e.g. for unsolicited advertisements
+	IPv6AllNodes   = net.ParseIP("ff02::1")
+	ipv6AllRouters = net.ParseIP("ff02::2")
+)
+
+// Our link-local IPv6 address, derived from the MAC if Dev has none.
+func (n *Network) LinkLocal() net.IP {
+	for _, a := range n.Localhost.IPv6() {
+		if a.IsLinkLocalUnicast() {
+			return a
+		}
+	}
+	return EUI64(net.ParseIP("fe80::"), n.Localhost.Mac)
+}
+
+// Find IPv6 hosts: ping ff02::1, which most hosts (not Windows) answer, and
+// solicit routers. Returns everyone answering (and all DAD probes and NDP
+// traffic seen meanwhile) until <ctx> is done or NDPScanTimeout elapsed.
+// Results are also merged into the HostMap by the passive listener.
+func (n *Network) ScanIPv6(ctx context.Context) ([]Host, error) {
+	var lock sync.Mutex
+	found := make(map[string]Host, init_size)
+	reason := ListenerReason{Class: ReplyListener, Name: "ipv6 scan"}
+	listener, err := n.Listeners.Add(reason, func(pkt gopacket.Packet) {
+		eth, ok := pkt.LinkLayer().(*layers.Ethernet)
+		ip, isIPv6 := pkt.NetworkLayer().(*layers.IPv6)
+		icmplayer := pkt.Layer(layers.LayerTypeICMPv6)
+		if !ok || !isIPv6 || icmplayer == nil || bytes.Equal(eth.SrcMAC, n.Localhost.Mac) {
+			return
+		}
+		addr := ip.SrcIP
+		switch icmplayer.(*layers.ICMPv6).TypeCode.Type() {
+		case layers.ICMPv6TypeEchoReply, layers.ICMPv6TypeRouterAdvertisement,
+			layers.ICMPv6TypeNeighborAdvertisement:
+		case layers.ICMPv6TypeNeighborSolicitation:
+			// DAD probe: the target is about to be configured
+			l := pkt.Layer(layers.LayerTypeICMPv6NeighborSolicitation)
+			if l != nil && addr.IsUnspecified() {
+				addr = l.(*layers.ICMPv6NeighborSolicitation).TargetAddress
+			}
+		default:
+			return
+		}
+		if addr.IsUnspecified() {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		h := found[eth.SrcMAC.String()]
+		h.Mac = append(net.HardwareAddr(nil), eth.SrcMAC...)
+		h.AddAddr(append(net.IP(nil), addr...))
+		found[h.Mac.String()] = h
+	}, LayerFilter(layers.LayerTypeICMPv6))
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Remove()
+	log.Printf("[+] scanning %v", IPv6AllNodes)
+
+	if err := n.ping6(IPv6AllNodes); err != nil {
+		log.Printf("write err: %v", err)
+	}
+	if err := n.solicitRouters(); err != nil {
+		log.Printf("write err: %v", err)
+	}
+
+	timer := time.NewTimer(NDPScanTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	hosts := make([]Host, 0, len(found))
+	for _, h := range found {
+		hosts = append(hosts, h)
+	}
+	log.Printf("[+] scan: %d ipv6 hosts", len(hosts))
+	return hosts, nil
+}
+
+// ICMPv6 echo request to <dst>
+func (n *Network) ping6(dst net.IP) error {
+	leth := layers.Ethernet{
+		SrcMAC:       n.Localhost.Mac,
+		DstMAC:       MulticastMAC6(dst),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	lip := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      n.source6(dst),
+		DstIP:      dst,
+	}
+	licmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0),
+	}
+	licmp.SetNetworkLayerForChecksum(&lip)
+	lecho := layers.ICMPv6Echo{
+		Identifier: uint16(time.Now().UnixNano()),
+		SeqNumber:  1,
+	}
+	return n.Send(&leth, &lip, &licmp, &lecho)
+}
+
+// Router Solicitation to ff02::2, routers answer with an RA
+func (n *Network) solicitRouters() error {
+	leth := layers.Ethernet{
+		SrcMAC:       n.Localhost.Mac,
+		DstMAC:       MulticastMAC6(ipv6AllRouters),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	lip := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      n.LinkLocal(),
+		DstIP:      ipv6AllRouters,
+	}
+	licmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterSolicitation, 0),
+	}
+	licmp.SetNetworkLayerForChecksum(&lip)
+	lrs := layers.ICMPv6RouterSolicitation{
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: n.Localhost.Mac},
+		},
+	}
+	return n.Send(&leth, &lip, &licmp, &lrs)
+}
+
+// Our IPv6 address to talk to <dst> from: a global one in the same subnet, if
+// any, the link-local one otherwise.
+func (n *Network) source6(dst net.IP) net.IP {
+	if !dst.IsLinkLocalUnicast() {
+		for _, subnet := range n.subnets {
+			if subnet.IP.To4() == nil && subnet.Contains(dst) {
+				return subnet.IP
+			}
+		}
+	}
+	return n.LinkLocal()
+}
+
+// Multicast a Neighbor Solicitation for <target>, the IPv6 version of an ARP
+// request.
+func (n *Network) requestNDP(target net.IP) error {
+	dst := SolicitedNode(target)
+	leth := layers.Ethernet{
+		SrcMAC:       n.Localhost.Mac,
+		DstMAC:       MulticastMAC6(dst),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	lip := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      n.source6(target),
+		DstIP:      dst,
+	}
+	licmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	licmp.SetNetworkLayerForChecksum(&lip)
+	lns := layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: n.Localhost.Mac},
+		},
+	}
+	return n.Send(&leth, &lip, &licmp, &lns)
+}
+
+// SLAAC address of <mac> in the /64 <prefix>
+func EUI64(prefix net.IP, mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.To16()[:8])
+	copy(ip[8:], mac[:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:], mac[3:])
+	return ip
+}
+
+// MAC an EUI-64 based IPv6 address was derived from, nil for other (e.g.
+// privacy) addresses.
+func MACFromEUI64(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// ff02::1:ffXX:XXXX
+func SolicitedNode(ip net.IP) net.IP {
+	sn := net.ParseIP("ff02::1:ff00:0")
+	copy(sn[13:], ip.To16()[13:])
+	return sn
+}
+
+// 33:33:xx:xx:xx:xx
+func MulticastMAC6(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
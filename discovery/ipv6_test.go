@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// A Network at 2001:db8::1/64 on a Pipe, the other end of which is a peer
+// with MAC testMac and address 2001:db8::5 answering neighbor and router
+// solicitations and pings. Every packet we send is passed on to the returned
+// channel.
+func testIPv6Peer(t *testing.T) (*Network, <-chan gopacket.Packet) {
+	ours, theirs := util.Pipe()
+	t.Cleanup(func() { theirs.Close() })
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	_, subnet, _ := net.ParseCIDR("2001:db8::1/64")
+	subnet.IP = net.ParseIP("2001:db8::1")
+	n := NewNetworkIO(ours, "pipe", Host{Mac: mac}, subnet)
+	t.Cleanup(n.Close)
+
+	peer := EUI64(net.ParseIP("fe80::"), testMac)
+	target := net.ParseIP("2001:db8::5")
+	na := testICMPv6To(t, testMac, mac, target, subnet.IP,
+		layers.ICMPv6TypeNeighborAdvertisement,
+		&layers.ICMPv6NeighborAdvertisement{
+			Flags:         0x60, // solicited, override
+			TargetAddress: target,
+			Options: layers.ICMPv6Options{
+				{Type: layers.ICMPv6OptTargetAddress, Data: testMac},
+			},
+		})
+	pong := testICMPv6To(t, testMac, mac, peer, n.LinkLocal(),
+		layers.ICMPv6TypeEchoReply, &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1})
+	ra := testICMPv6(t, testMac, peer, layers.ICMPv6TypeRouterAdvertisement,
+		&layers.ICMPv6RouterAdvertisement{HopLimit: 64, RouterLifetime: 1800})
+
+	sent := make(chan gopacket.Packet, 16)
+	go func() {
+		for {
+			data, _, err := theirs.ReadPacketData()
+			if err != nil {
+				return
+			}
+			pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			select {
+			case sent <- pkt:
+			default:
+			}
+			icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			if !ok {
+				continue
+			}
+			var reply []byte
+			switch icmp.TypeCode.Type() {
+			case layers.ICMPv6TypeNeighborSolicitation:
+				ns := pkt.Layer(layers.LayerTypeICMPv6NeighborSolicitation)
+				if ns != nil && ns.(*layers.ICMPv6NeighborSolicitation).TargetAddress.Equal(target) {
+					reply = na
+				}
+			case layers.ICMPv6TypeEchoRequest:
+				reply = pong
+			case layers.ICMPv6TypeRouterSolicitation:
+				reply = ra
+			}
+			if reply != nil {
+				theirs.WritePacketData(reply)
+			}
+		}
+	}()
+	return n, sent
+}
+
+func TestResolveIPv6(t *testing.T) {
+	n, sent := testIPv6Peer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	h, err := n.ResolveIP(ctx, "2001:db8::5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Mac.String() != testMac.String() {
+		t.Errorf("resolved %v", h)
+	}
+	if got := n.HostMap().GetIP("2001:db8::5"); got == nil || got.Mac.String() != testMac.String() {
+		t.Errorf("not learned: %v", got)
+	}
+
+	// the solicitation: to the solicited-node group, from our global address
+	pkt := <-sent
+	ip, ok := pkt.NetworkLayer().(*layers.IPv6)
+	eth := pkt.LinkLayer().(*layers.Ethernet)
+	group := SolicitedNode(net.ParseIP("2001:db8::5"))
+	if !ok || !ip.DstIP.Equal(group) || eth.DstMAC.String() != MulticastMAC6(group).String() ||
+		!ip.SrcIP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("solicitation: %v", pkt)
+	}
+}
+
+func TestScanIPv6(t *testing.T) {
+	defer func(timeout time.Duration) { NDPScanTimeout = timeout }(NDPScanTimeout)
+	NDPScanTimeout = time.Millisecond * 200
+
+	n, _ := testIPv6Peer(t)
+	found, err := n.ScanIPv6(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := EUI64(net.ParseIP("fe80::"), testMac)
+	if len(found) != 1 || found[0].Mac.String() != testMac.String() || !found[0].Addr.Equal(peer) {
+		t.Errorf("found %v", found)
+	}
+}
@@ -0,0 +1,272 @@
+package discovery
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/tinygoprogs/netmess/util"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// What a listener is there for.
+type ListenerClass int
+
+const (
+	// bookkeeping on whatever passes by, e.g. learning hosts
+	PassiveListener ListenerClass = iota
+	// waits for answers to our own packets, e.g. ARP resolution or scans
+	ReplyListener
+	// reacts to other hosts' packets, e.g. spoofers answering queries
+	InteractiveListener
+)
+
+func (c ListenerClass) String() string {
+	switch c {
+	case PassiveListener:
+		return "passive"
+	case ReplyListener:
+		return "reply"
+	case InteractiveListener:
+		return "interactive"
+	}
+	return "unknown"
+}
+
+// Why a listener is registered, unique per Network.
+type ListenerReason struct {
+	Class ListenerClass
+	Name  string
+}
+
+func (r ListenerReason) String() string {
+	return r.Class.String() + ": " + r.Name
+}
+
+// Whether a listener wants a packet, decided by the dispatcher before the
+// packet is queued.
+type ListenerFilter func(gopacket.Packet) bool
+
+// Only packets containing all of <types>.
+func LayerFilter(types ...gopacket.LayerType) ListenerFilter {
+	return func(pkt gopacket.Packet) bool {
+		for _, t := range types {
+			if pkt.Layer(t) == nil {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Only packets matching tcpdump expression <expr>, needs libpcap to compile
+// it (see util.CompileBPF).
+func (n *Network) BPFFilter(expr string) (ListenerFilter, error) {
+	match, err := util.MatchBPF(n.pio.LinkType(), expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(pkt gopacket.Packet) bool {
+		return match(pkt.Data())
+	}, nil
+}
+
+// Each listener gets its own queue of ListenerQueueSize packets. Live
+// captures drop packets for a listener while its queue is full, offline ones
+// wait for it.
+var ListenerQueueSize = 1024
+
+// Counters of a single listener.
+type ListenerStats struct {
+	Reason ListenerReason
+	// packets queued, skipped by the filters and dropped due to a full queue
+	Queued   uint64
+	Filtered uint64
+	Dropped  uint64
+	// packets waiting right now
+	Backlog int
+}
+
+// A registered listener, see listenerMap.Add.
+type Listener struct {
+	reason  ListenerReason
+	f       func(gopacket.Packet)
+	filters []ListenerFilter
+	m       *listenerMap
+	queue   chan gopacket.Packet
+	// closed by Remove, done once the goroutine calling f returned
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	queued   uint64
+	filtered uint64
+	dropped  uint64
+}
+
+func (l *Listener) Reason() ListenerReason {
+	return l.reason
+}
+
+// Unregister; f may still be running for the current packet. Does nothing on
+// nil, so it can be deferred right after a failing Add.
+func (l *Listener) Remove() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		l.m.lock.Lock()
+		if l.m.funcs[l.reason] == l {
+			delete(l.m.funcs, l.reason)
+		}
+		l.m.lock.Unlock()
+	})
+}
+
+func (l *Listener) Stats() ListenerStats {
+	return ListenerStats{
+		Reason:   l.reason,
+		Queued:   atomic.LoadUint64(&l.queued),
+		Filtered: atomic.LoadUint64(&l.filtered),
+		Dropped:  atomic.LoadUint64(&l.dropped),
+		Backlog:  len(l.queue),
+	}
+}
+
+func (l *Listener) run() {
+	defer close(l.done)
+	for {
+		select {
+		case pkt, ok := <-l.queue:
+			if !ok {
+				return
+			}
+			l.f(pkt)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *Listener) wants(pkt gopacket.Packet) bool {
+	for _, filter := range l.filters {
+		if !filter(pkt) {
+			return false
+		}
+	}
+	return true
+}
+
+// Holding the listeners of a Network, each fed through its own queue and
+// goroutine, so a slow one does not stall the others.
+type listenerMap struct {
+	lock  sync.RWMutex
+	funcs map[ListenerReason]*Listener
+	// wait for full queues instead of dropping, see ListenerQueueSize
+	lossless bool
+	// no more packets, see close
+	closed bool
+}
+
+func newListenerMap() *listenerMap {
+	return &listenerMap{funcs: make(map[ListenerReason]*Listener, 4)}
+}
+
+// Call <f> with every packet passing all <filters>, until Listener.Remove.
+func (m *listenerMap) Add(reason ListenerReason, f func(gopacket.Packet), filters ...ListenerFilter) (*Listener, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, errors.New("capture done")
+	}
+	if _, exists := m.funcs[reason]; exists {
+		return nil, errors.New("exists already")
+	}
+	l := &Listener{
+		reason:  reason,
+		f:       f,
+		filters: filters,
+		m:       m,
+		queue:   make(chan gopacket.Packet, ListenerQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.funcs[reason] = l
+	go l.run()
+	return l, nil
+}
+
+// Counters of all listeners, ordered by reason.
+func (m *listenerMap) Stats() []ListenerStats {
+	m.lock.RLock()
+	stats := make([]ListenerStats, 0, len(m.funcs))
+	for _, l := range m.funcs {
+		stats = append(stats, l.Stats())
+	}
+	m.lock.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Reason.String() < stats[j].Reason.String()
+	})
+	return stats
+}
+
+func (m *listenerMap) snapshot() []*Listener {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	listeners := make([]*Listener, 0, len(m.funcs))
+	for _, l := range m.funcs {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// Queue <pkt> for every listener wanting it. Only called by the dispatcher,
+// which gives up waiting for (lossless) queues once <quit> is closed.
+func (m *listenerMap) dispatch(pkt gopacket.Packet, quit <-chan struct{}) {
+	for _, l := range m.snapshot() {
+		if !l.wants(pkt) {
+			atomic.AddUint64(&l.filtered, 1)
+			continue
+		}
+		if m.lossless {
+			select {
+			case l.queue <- pkt:
+				atomic.AddUint64(&l.queued, 1)
+			case <-l.stop:
+			case <-quit:
+				return
+			}
+			continue
+		}
+		select {
+		case l.queue <- pkt:
+			atomic.AddUint64(&l.queued, 1)
+		case <-l.stop:
+		default:
+			if atomic.AddUint64(&l.dropped, 1) == 1 {
+				log.Printf("[+] listener %v: queue full, dropping packets", l.reason)
+			}
+		}
+	}
+}
+
+// No more packets: let every listener finish its queue, unless <quit> is
+// closed. Only called by the dispatcher.
+func (m *listenerMap) close(quit <-chan struct{}) {
+	m.lock.Lock()
+	m.closed = true
+	m.lock.Unlock()
+	listeners := m.snapshot()
+	for _, l := range listeners {
+		close(l.queue)
+	}
+	for _, l := range listeners {
+		select {
+		case <-l.done:
+		case <-quit:
+			return
+		}
+	}
+}
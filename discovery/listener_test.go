@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListeners(t *testing.T) {
+	defer func(size int) { ListenerQueueSize = size }(ListenerQueueSize)
+	ListenerQueueSize = 4
+
+	ours, theirs := util.Pipe()
+	defer theirs.Close()
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	n := NewNetworkIO(ours, "pipe", Host{Mac: mac})
+	defer n.Close()
+
+	var fast, arps uint64
+	block := make(chan struct{})
+	slow, err := n.Listeners.Add(ListenerReason{Class: PassiveListener, Name: "test slow"},
+		func(gopacket.Packet) { <-block })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(block)
+	fastReason := ListenerReason{Class: ReplyListener, Name: "test fast"}
+	l, err := n.Listeners.Add(fastReason, func(gopacket.Packet) { atomic.AddUint64(&fast, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	arp, err := n.Listeners.Add(ListenerReason{Class: ReplyListener, Name: "test arp"},
+		func(gopacket.Packet) { atomic.AddUint64(&arps, 1) },
+		LayerFilter(layers.LayerTypeARP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Listeners.Add(fastReason, func(gopacket.Packet) {}); err == nil {
+		t.Error("added a reason twice")
+	}
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		var frame []byte
+		if i%10 == 0 {
+			frame = testARP(t, testMac, mac, net.IP{10, 0, 0, 2})
+		} else {
+			frame = testUDP(t, mac)
+		}
+		if err := theirs.WritePacketData(frame); err != nil {
+			t.Fatal(err)
+		}
+		// give the fast listener a chance to keep up
+		time.Sleep(time.Millisecond)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&fast) < count && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := atomic.LoadUint64(&fast); got != count {
+		t.Errorf("fast listener got %d of %d packets", got, count)
+	}
+	if got := atomic.LoadUint64(&arps); got != count/10 {
+		t.Errorf("ARP listener got %d packets", got)
+	}
+	if s := arp.Stats(); s.Queued != count/10 || s.Filtered != count-count/10 {
+		t.Errorf("ARP listener stats %+v", s)
+	}
+	s := slow.Stats()
+	// one packet is in the slow listener's hands, the rest is queued or dropped
+	if s.Dropped == 0 || s.Backlog != ListenerQueueSize || s.Queued+s.Dropped != count {
+		t.Errorf("slow listener stats %+v", s)
+	}
+	if stats := n.Listeners.Stats(); len(stats) < 3 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	l.Remove()
+	l.Remove()
+	for _, s := range n.Listeners.Stats() {
+		if s.Reason == fastReason {
+			t.Error("removed listener still registered")
+		}
+	}
+	if _, err := n.Listeners.Add(fastReason, func(gopacket.Packet) {}); err != nil {
+		t.Errorf("re-adding removed reason: %v", err)
+	}
+}
+
+var testMac = net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2}
+
+// ARP reply from <src> claiming <ip>
+func testARP(t *testing.T, src, dst net.HardwareAddr, ip net.IP) []byte {
+	return testFrame(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   src,
+			SourceProtAddress: ip,
+			DstHwAddress:      dst,
+			DstProtAddress:    net.IP{10, 0, 0, 1},
+		})
+}
+
+func testUDP(t *testing.T, dst net.HardwareAddr) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{10, 0, 0, 2},
+		DstIP:    net.IP{10, 0, 0, 1},
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 9}
+	udp.SetNetworkLayerForChecksum(ip)
+	return testFrame(t,
+		&layers.Ethernet{SrcMAC: testMac, DstMAC: dst,
+			EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload("netmess"))
+}
+
+func testFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
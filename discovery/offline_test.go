@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write <pkts> (layer stacks) to a pcap file, one per second
+func writePcap(t *testing.T, pkts ...[]gopacket.SerializableLayer) string {
+	name := filepath.Join(t.TempDir(), "test.pcap")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(0xffff, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, l := range pkts {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(buf.Bytes()),
+			Length:        len(buf.Bytes()),
+		}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return name
+}
+
+func TestOfflineNetwork(t *testing.T) {
+	a, _ := net.ParseMAC("00:11:22:00:00:0a")
+	b, _ := net.ParseMAC("00:11:22:00:00:0b")
+	arp := []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: a, DstMAC: b, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   a,
+			SourceProtAddress: net.IP{10, 0, 0, 1},
+			DstHwAddress:      b,
+			DstProtAddress:    net.IP{10, 0, 0, 2},
+		},
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      127,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IP{10, 0, 0, 2},
+		DstIP:    net.IP{10, 0, 0, 1},
+	}
+	tcp := &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 64240,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{8}},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		}}
+	tcp.SetNetworkLayerForChecksum(ip)
+	syn := []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: b, DstMAC: a, EthernetType: layers.EthernetTypeIPv4},
+		ip, tcp,
+	}
+	ip = &layers.IPv4{Version: 4, TTL: 50, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IP{8, 8, 8, 8}, DstIP: net.IP{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: 53, DstPort: 50000}
+	udp.SetNetworkLayerForChecksum(ip)
+	routed := []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: a, DstMAC: b, EthernetType: layers.EthernetTypeIPv4},
+		ip, udp,
+	}
+
+	n, err := NewOfflineNetwork(writePcap(t, arp, syn, routed), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	select {
+	case <-n.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("capture not done")
+	}
+
+	if len(n.Hosts()) != 2 || n.HostMap().GetIP("8.8.8.8") != nil {
+		t.Errorf("hosts: %v", n.Hosts())
+	}
+	h := n.HostMap().GetIP("10.0.0.1")
+	if h == nil || h.Mac.String() != a.String() ||
+		!h.LastSeen.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("10.0.0.1: %+v", h)
+	}
+	h = n.HostMap().GetIP("10.0.0.2")
+	if h == nil || h.Mac.String() != b.String() || h.Meta.OS != "Windows" ||
+		h.Meta.SYN != "64240:1460:mss,nop,ws,nop,nop,sok" {
+		t.Errorf("10.0.0.2: %+v", h)
+	}
+	if err := n.Send(arp...); err == nil {
+		t.Error("sent offline")
+	}
+}
@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+// Listener every Network starts with, see learn.
+var passiveReason = ListenerReason{Class: PassiveListener, Name: "passive discovery"}
+
+// Learn IP/MAC pairs (and HostMeta, see fingerprint) from ARP, IPv4, IPv6,
+// DHCP and NDP packets into the HostMap. Only on-link sources are trusted,
+// everything else is some router's MAC. SLAAC addresses (EUI-64) are mapped
+// back to the MAC they were derived from and addresses being configured are
+// learned from DAD probes. Packets sent by us are ignored, as spoofers forge
+// addresses of others. Never sends a packet.
+func (n *Network) learn(pkt gopacket.Packet) {
+	eth, ok := pkt.LinkLayer().(*layers.Ethernet)
+	if !ok || bytes.Equal(eth.SrcMAC, n.Localhost.Mac) {
+		return
+	}
+	seen := pkt.Metadata().Timestamp
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	n.fingerprint(pkt, eth, seen)
+
+	if l := pkt.Layer(layers.LayerTypeARP); l != nil {
+		arp := l.(*layers.ARP)
+		if arp.HwAddressSize == 6 && arp.ProtAddressSize == 4 {
+			n.saw(arp.SourceProtAddress, arp.SourceHwAddress, seen)
+		}
+		return
+	}
+
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		n.saw(ip.SrcIP, eth.SrcMAC, seen)
+	case *layers.IPv6:
+		var mac net.HardwareAddr = eth.SrcMAC
+		if l := pkt.Layer(layers.LayerTypeICMPv6NeighborSolicitation); l != nil {
+			ns := l.(*layers.ICMPv6NeighborSolicitation)
+			mac = ndpLinkAddr(pkt, ns.Options)
+			if ip.SrcIP.IsUnspecified() {
+				// DAD probe: the sender is configuring the target right now
+				n.saw(ns.TargetAddress, eth.SrcMAC, seen)
+			} else {
+				n.sawEUI64(ns.TargetAddress, seen)
+			}
+		}
+		n.saw(ip.SrcIP, mac, seen)
+		n.sawEUI64(ip.DstIP, seen)
+	}
+
+	if l := pkt.Layer(layers.LayerTypeDHCPv4); l != nil {
+		// the lease of an ACK, the client configures it right away
+		dhcp := l.(*layers.DHCPv4)
+		for _, o := range dhcp.Options {
+			if o.Type == layers.DHCPOptMessageType && len(o.Data) == 1 &&
+				layers.DHCPMsgType(o.Data[0]) == layers.DHCPMsgTypeAck &&
+				len(dhcp.ClientHWAddr) == 6 {
+				n.saw(dhcp.YourClientIP, dhcp.ClientHWAddr, seen)
+			}
+		}
+	}
+	if l := pkt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement); l != nil {
+		na := l.(*layers.ICMPv6NeighborAdvertisement)
+		n.saw(na.TargetAddress, ndpLinkAddr(pkt, na.Options), seen)
+	}
+}
+
+// <ip> is at <mac>, if plausible
+func (n *Network) saw(ip net.IP, mac net.HardwareAddr, seen time.Time) {
+	if len(mac) != 6 || mac[0]&0x01 != 0 || bytes.Equal(mac, n.Localhost.Mac) {
+		// multicast/broadcast
+		return
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return
+	}
+	if !n.onLink(ip) && !bytes.Equal(MACFromEUI64(ip), mac) {
+		// not on-link, unless the address was derived from the MAC
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n.hosts.Update(&Host{
+		Addr:     append(net.IP(nil), ip...),
+		Mac:      append(net.HardwareAddr(nil), mac...),
+		LastSeen: seen,
+	})
+}
+
+// Merge the SLAAC address <ip> into the host whose MAC it was derived from, if
+// that host was seen on the link.
+func (n *Network) sawEUI64(ip net.IP, seen time.Time) {
+	if mac := MACFromEUI64(ip); mac != nil && n.hosts.GetMac(mac) != nil {
+		n.saw(ip, mac, seen)
+	}
+}
+
+// Whether <ip> is directly reachable on Dev. Without known subnets (e.g.
+// offline) every private address is.
+func (n *Network) onLink(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if len(n.subnets) == 0 {
+		return ip.IsPrivate()
+	}
+	for _, subnet := range n.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
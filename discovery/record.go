@@ -0,0 +1,180 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng interface ids of a Recorder
+const (
+	recordSniffed  = 0
+	recordInjected = 1
+)
+
+// Writes packets to rotating pcapng files <prefix>.0000.pcapng,
+// <prefix>.0001.pcapng, ..., sniffed packets on interface 0 and injected ones
+// on interface 1 ("<name> (injected)"), see Network.Record.
+type Recorder struct {
+	// start a new file after MaxSize bytes or MaxAge, 0 disables either
+	MaxSize int64
+	MaxAge  time.Duration
+	// remove all but the Keep newest files, 0 keeps all
+	Keep int
+
+	prefix string
+	name   string
+	link   layers.LinkType
+	lock   sync.Mutex
+	f      *os.File
+	w      *pcapgo.NgWriter
+	size   int64
+	opened time.Time
+	seq    int
+	files  []string
+}
+
+func NewRecorder(prefix, name string, link layers.LinkType) (*Recorder, error) {
+	r := &Recorder{
+		MaxSize: 100 << 20,
+		prefix:  prefix,
+		name:    name,
+		link:    link,
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// counts what the NgWriter writes
+type countingFile struct {
+	f    *os.File
+	size *int64
+}
+
+func (c countingFile) Write(p []byte) (int, error) {
+	n, err := c.f.Write(p)
+	*c.size += int64(n)
+	return n, err
+}
+
+// called with lock held
+func (r *Recorder) rotate() error {
+	if r.f != nil {
+		r.w.Flush()
+		r.f.Close()
+	}
+	var name string
+	var f *os.File
+	var err error
+	for {
+		// never overwrite earlier recordings
+		name = fmt.Sprintf("%s.%04d.pcapng", r.prefix, r.seq)
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		r.seq++
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		r.f = nil
+		return err
+	}
+	r.size = 0
+	w, err := pcapgo.NewNgWriterInterface(countingFile{f, &r.size}, pcapgo.NgInterface{
+		Name:                r.name,
+		Description:         "sniffed",
+		LinkType:            r.link,
+		TimestampResolution: 9,
+	}, pcapgo.DefaultNgWriterOptions)
+	if err == nil {
+		_, err = w.AddInterface(pcapgo.NgInterface{
+			Name:                r.name + " (injected)",
+			Description:         "injected",
+			LinkType:            r.link,
+			TimestampResolution: 9,
+		})
+	}
+	if err != nil {
+		f.Close()
+		r.f = nil
+		return err
+	}
+	r.f, r.w, r.opened = f, w, time.Now()
+
+	r.files = append(r.files, name)
+	for r.Keep > 0 && len(r.files) > r.Keep {
+		os.Remove(r.files[0])
+		r.files = r.files[1:]
+	}
+	return nil
+}
+
+// Record <data>, captured as described by <ci> or, if <injected>, sent by us.
+func (r *Recorder) Write(ci gopacket.CaptureInfo, data []byte, injected bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if (r.MaxSize > 0 && r.size >= r.MaxSize) ||
+		(r.MaxAge > 0 && time.Since(r.opened) >= r.MaxAge) || r.f == nil {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	ci.InterfaceIndex = recordSniffed
+	if injected {
+		ci.InterfaceIndex = recordInjected
+	}
+	if err := r.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	// an audit trail is no good if it's lost in a buffer
+	return r.w.Flush()
+}
+
+// Files written so far (and not removed, see Keep), oldest first.
+func (r *Recorder) Files() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.files...)
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	r.w.Flush()
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// Record every packet dispatched to the listeners and every packet sent via
+// Send to <r>, nil stops recording. Note that injected packets are usually
+// captured (and recorded) a second time as sniffed ones.
+func (n *Network) Record(r *Recorder) {
+	n.recordLock.Lock()
+	n.recorder = r
+	n.recordLock.Unlock()
+}
+
+func (n *Network) record(ci gopacket.CaptureInfo, data []byte, injected bool) {
+	n.recordLock.RLock()
+	r := n.recorder
+	n.recordLock.RUnlock()
+	if r == nil {
+		return
+	}
+	if err := r.Write(ci, data, injected); err != nil {
+		log.Printf("record err: %v", err)
+	}
+}
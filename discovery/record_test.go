@@ -0,0 +1,65 @@
+package discovery
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	r, err := NewRecorder(filepath.Join(t.TempDir(), "audit"), "eth0", layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxSize = 1024
+	r.Keep = 2
+	data := make([]byte, 300)
+	for i := 0; i < 10; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		if err := r.Write(ci, data, i%2 == 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := r.Files()
+	if len(files) != 2 {
+		t.Fatalf("files: %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ng, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sniffed, injected int
+	for {
+		_, ci, err := ng.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if ci.InterfaceIndex == recordInjected {
+			injected++
+		} else {
+			sniffed++
+		}
+	}
+	if sniffed == 0 || injected == 0 {
+		t.Errorf("%d sniffed, %d injected", sniffed, injected)
+	}
+	if intf, err := ng.Interface(recordInjected); err != nil || intf.Name != "eth0 (injected)" {
+		t.Errorf("interface: %+v %v", intf, err)
+	}
+}
@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// an ARP request (or IPv6 Neighbor Solicitation) is repeated ARPRetries
+	// times if unanswered, waiting ARPRetryDelay for the first reply and twice
+	// as long for each retry
+	ARPRetries    = 3
+	ARPRetryDelay = time.Millisecond * 500
+	// addresses that never answered are not asked again for ARPNegativeTTL
+	ARPNegativeTTL = time.Second * 30
+
+	ErrNoReply = errors.New("no ARP/NDP reply")
+)
+
+// A single ARP/NDP resolution, shared by everyone looking up the same address.
+type arpLookup struct {
+	done chan struct{}
+	host *Host
+	err  error
+}
+
+type arpResolver struct {
+	lock    sync.Mutex
+	pending map[string]*arpLookup
+	// ip -> end of negative caching
+	failed map[string]time.Time
+}
+
+func newARPResolver() *arpResolver {
+	return &arpResolver{
+		pending: make(map[string]*arpLookup, init_size),
+		failed:  make(map[string]time.Time, init_size),
+	}
+}
+
+// Return Host information for <ip>, asking via ARP (IPv4) or Neighbor
+// Solicitation (IPv6) if it is unknown.
+// Concurrent lookups of the same address share their requests. Gives up with
+// ErrNoReply after ARPRetries, or when <ctx> is done.
+func (n *Network) ResolveIP(ctx context.Context, ip string) (*Host, error) {
+	if host := n.hosts.GetIP(ip); host != nil {
+		return host, nil
+	}
+	tmp := net.ParseIP(ip)
+	if tmp == nil {
+		return nil, errors.New("parsing ip")
+	}
+	target := tmp
+	if ip4 := tmp.To4(); ip4 != nil {
+		target = ip4
+	}
+
+	key := target.String()
+	r := n.resolver
+	r.lock.Lock()
+	if until, failed := r.failed[key]; failed {
+		if time.Now().Before(until) {
+			r.lock.Unlock()
+			return nil, ErrNoReply
+		}
+		delete(r.failed, key)
+	}
+	l, pending := r.pending[key]
+	if !pending {
+		l = &arpLookup{done: make(chan struct{})}
+		r.pending[key] = l
+		go n.resolve(target, l)
+	}
+	r.lock.Unlock()
+
+	select {
+	case <-l.done:
+		return l.host, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Request <target> until it answers or we run out of retries, then complete
+// <l>. Runs independent of the callers' contexts, which only stop waiting.
+func (n *Network) resolve(target net.IP, l *arpLookup) {
+	key := target.String()
+	reply := make(chan net.HardwareAddr, 1)
+	answer := func(mac net.HardwareAddr) {
+		select {
+		case reply <- append(net.HardwareAddr(nil), mac...):
+		default:
+		}
+	}
+	request := n.requestARP
+	reason := ListenerReason{Class: ReplyListener, Name: "awaiting ARP reply " + key}
+	filter := LayerFilter(layers.LayerTypeARP)
+	listener := func(pkt gopacket.Packet) {
+		arplayer := pkt.Layer(layers.LayerTypeARP)
+		if arplayer == nil {
+			return
+		}
+		arp := arplayer.(*layers.ARP)
+		if arp.Operation == layers.ARPReply &&
+			bytes.Equal(arp.SourceProtAddress, target) {
+			answer(arp.SourceHwAddress)
+		}
+	}
+	if target.To4() == nil {
+		request = n.requestNDP
+		reason = ListenerReason{Class: ReplyListener, Name: "awaiting NDP reply " + key}
+		filter = LayerFilter(layers.LayerTypeICMPv6NeighborAdvertisement)
+		listener = func(pkt gopacket.Packet) {
+			nalayer := pkt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement)
+			if nalayer == nil {
+				return
+			}
+			na := nalayer.(*layers.ICMPv6NeighborAdvertisement)
+			if na.TargetAddress.Equal(target) {
+				if mac := ndpLinkAddr(pkt, na.Options); mac != nil {
+					answer(mac)
+				}
+			}
+		}
+	}
+	handle, err := n.Listeners.Add(reason, listener, filter)
+
+	if err == nil {
+		delay := ARPRetryDelay
+		for i := 0; i <= ARPRetries && l.host == nil; i++ {
+			log.Printf("[+] requesting %v", target)
+			if err := request(target); err != nil {
+				log.Printf("write err: %v", err)
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case mac := <-reply:
+				h := &Host{Addr: target, Mac: mac}
+				n.hosts.Update(h)
+				if l.host = n.hosts.GetIP(key); l.host == nil {
+					l.host = h
+				}
+				log.Printf("[+] %s: done", reason)
+			case <-timer.C:
+				delay *= 2
+			}
+			timer.Stop()
+		}
+		handle.Remove()
+		if l.host == nil {
+			err = ErrNoReply
+		}
+	}
+	l.err = err
+
+	r := n.resolver
+	r.lock.Lock()
+	delete(r.pending, key)
+	if err == ErrNoReply {
+		r.failed[key] = time.Now().Add(ARPNegativeTTL)
+	}
+	r.lock.Unlock()
+	close(l.done)
+}
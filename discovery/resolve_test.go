@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Network on a LAN 10.0.0.0/24 and a counter of the ARP requests it sends,
+// signalling each one on the returned channel.
+func testResolver(t *testing.T) (*vlan.LAN, *Network, *int32, <-chan struct{}) {
+	retries, delay := ARPRetries, ARPRetryDelay
+	t.Cleanup(func() { ARPRetries, ARPRetryDelay = retries, delay })
+	ARPRetries, ARPRetryDelay = 2, time.Millisecond*50
+
+	lan, err := vlan.New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lan.Close)
+	pio, mac, addr, err := lan.Tap("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetworkIO(pio, "vlan", Host{Mac: mac}, addr)
+	t.Cleanup(n.Close)
+
+	sniffer, _, _, err := lan.Tap("10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sniffer.Close() })
+	requests := new(int32)
+	seen := make(chan struct{}, 64)
+	go func() {
+		for {
+			data, _, err := sniffer.ReadPacketData()
+			if err != nil {
+				return
+			}
+			pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			if arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP); ok &&
+				arp.Operation == layers.ARPRequest && net.HardwareAddr(arp.SourceHwAddress).String() == mac.String() {
+				atomic.AddInt32(requests, 1)
+				seen <- struct{}{}
+			}
+		}
+	}()
+	return lan, n, requests, seen
+}
+
+func TestResolveIPRetry(t *testing.T) {
+	lan, n, requests, seen := testResolver(t)
+	type result struct {
+		host *Host
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		h, err := n.ResolveIP(context.Background(), "10.0.0.5")
+		c <- result{h, err}
+	}()
+	select {
+	case <-seen:
+	case <-time.After(time.Second):
+		t.Fatal("no request")
+	}
+	// too late for the first request
+	late, err := lan.AddHost("late", "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-c
+	if r.err != nil || r.host.Mac.String() != late.Mac.String() {
+		t.Fatalf("got %+v, %v", r.host, r.err)
+	}
+	select {
+	case <-seen:
+	case <-time.After(time.Second):
+		t.Fatal("answered without a retry")
+	}
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Errorf("%d requests", got)
+	}
+}
+
+func TestResolveIPNegative(t *testing.T) {
+	_, n, requests, _ := testResolver(t)
+	if _, err := n.ResolveIP(context.Background(), "10.0.0.5"); err != ErrNoReply {
+		t.Fatalf("got %v", err)
+	}
+	sent := atomic.LoadInt32(requests)
+	if sent != int32(ARPRetries+1) {
+		t.Errorf("%d requests", sent)
+	}
+	if _, err := n.ResolveIP(context.Background(), "10.0.0.5"); err != ErrNoReply {
+		t.Errorf("got %v", err)
+	}
+	time.Sleep(ARPRetryDelay)
+	if got := atomic.LoadInt32(requests); got != sent {
+		t.Errorf("cached miss asked again, %d requests", got-sent)
+	}
+}
+
+func TestResolveIPShared(t *testing.T) {
+	_, n, requests, _ := testResolver(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := n.ResolveIP(context.Background(), "10.0.0.5"); err != ErrNoReply {
+				t.Errorf("got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(requests); got != int32(ARPRetries+1) {
+		t.Errorf("%d requests for 5 callers", got)
+	}
+}
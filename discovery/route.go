@@ -0,0 +1,140 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// how long Gateway and Gateway6 wait for the gateway to answer ARP/NDP
+var GatewayResolveTimeout = time.Second * 5
+
+// An entry of the kernel's main routing table going out through the Network's
+// device. Multipath routes are split into one Route per next hop on it.
+type Route struct {
+	// 0.0.0.0/0 or ::/0 for default routes
+	Dst *net.IPNet
+	// next hop, nil if Dst is on-link
+	Gateway net.IP
+	// preferred source address, may be nil
+	Src net.IP
+	// lower is preferred
+	Metric uint32
+}
+
+func (r Route) Default() bool {
+	ones, _ := r.Dst.Mask.Size()
+	return ones == 0
+}
+
+func (r Route) IPv6() bool {
+	return r.Dst.IP.To4() == nil
+}
+
+// Like "ip route", e.g. "default via 10.0.0.1 metric 100".
+func (r Route) String() string {
+	s := r.Dst.String()
+	if r.Default() {
+		s = "default"
+	}
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	return fmt.Sprintf("%s metric %d", s, r.Metric)
+}
+
+type RouteEventKind uint8
+
+const (
+	RouteAdded RouteEventKind = iota
+	RouteRemoved
+)
+
+func (k RouteEventKind) String() string {
+	switch k {
+	case RouteAdded:
+		return "added"
+	case RouteRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("RouteEventKind(%d)", uint8(k))
+}
+
+// A change of the routing table, see Network.WatchRoutes.
+type RouteEvent struct {
+	Kind  RouteEventKind
+	Route Route
+}
+
+// All IPv4 and IPv6 routes of Dev: IPv4 first, the most specific first, then
+// by metric.
+func (n *Network) Routes() ([]Route, error) {
+	routes, err := listRoutes(n.Dev.Index)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.IPv6() != b.IPv6() {
+			return b.IPv6()
+		}
+		aones, _ := a.Dst.Mask.Size()
+		bones, _ := b.Dst.Mask.Size()
+		if aones != bones {
+			return aones > bones
+		}
+		return a.Metric < b.Metric
+	})
+	return routes, nil
+}
+
+// The default routes of Dev with a next hop, IPv4 first, best metric first.
+func (n *Network) Gateways() ([]Route, error) {
+	routes, err := n.Routes()
+	if err != nil {
+		return nil, err
+	}
+	var gateways []Route
+	for _, r := range routes {
+		if r.Default() && r.Gateway != nil {
+			gateways = append(gateways, r)
+		}
+	}
+	return gateways, nil
+}
+
+// return the Host that the OS thinks is the current gateway, i.e. the next
+// hop of the IPv4 default route with the lowest metric, its MAC resolved
+func (n *Network) Gateway() (*Host, error) {
+	return n.gateway(false)
+}
+
+// return the Host that the OS thinks is the current IPv6 gateway, see Gateway
+func (n *Network) Gateway6() (*Host, error) {
+	return n.gateway(true)
+}
+
+func (n *Network) gateway(ipv6 bool) (*Host, error) {
+	gateways, err := n.Gateways()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range gateways {
+		if r.IPv6() != ipv6 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), GatewayResolveTimeout)
+		defer cancel()
+		return n.ResolveIP(ctx, r.Gateway.String())
+	}
+	if ipv6 {
+		return nil, errors.New("no ipv6 default route")
+	}
+	return nil, errors.New("no default route")
+}
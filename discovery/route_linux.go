@@ -0,0 +1,230 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+var errNoIfindex = errors.New("no routing table without a kernel interface")
+
+// Dump the main routing table via netlink, keeping routes out of <ifindex>.
+func listRoutes(ifindex int) ([]Route, error) {
+	if ifindex == 0 {
+		return nil, errNoIfindex
+	}
+	var routes []Route
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == unix.RTM_NEWROUTE {
+				routes = append(routes, parseRoute(msg.Data, ifindex)...)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Receive every RouteEvent of Dev from now on, until the returned cancel func
+// is called. Events are dropped if the channel (buffered, <size>) is full.
+func (n *Network) WatchRoutes(size int) (<-chan RouteEvent, func(), error) {
+	if n.Dev.Index == 0 {
+		return nil, nil, errNoIfindex
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	// like AFPacket, check for cancellation every 100ms
+	tv := unix.Timeval{Usec: 100000}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+
+	c := make(chan RouteEvent, size)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1<<16)
+	recv_loop:
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			nread, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				switch err {
+				case unix.EAGAIN, unix.EINTR:
+				case unix.ENOBUFS:
+					log.Printf("[+] route watch: netlink overrun, events lost")
+				default:
+					log.Printf("route watch: %v", err)
+					return
+				}
+				continue recv_loop
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:nread])
+			if err != nil {
+				continue
+			}
+			for _, msg := range msgs {
+				var kind RouteEventKind
+				switch msg.Header.Type {
+				case unix.RTM_NEWROUTE:
+					kind = RouteAdded
+				case unix.RTM_DELROUTE:
+					kind = RouteRemoved
+				default:
+					continue
+				}
+				for _, r := range parseRoute(msg.Data, n.Dev.Index) {
+					select {
+					case c <- RouteEvent{Kind: kind, Route: r}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			unix.Close(fd)
+			close(c)
+		})
+	}, nil
+}
+
+// The unicast routes of the main table in the RTM_NEWROUTE/RTM_DELROUTE
+// payload <data> going out through <ifindex>, one per next hop.
+func parseRoute(data []byte, ifindex int) []Route {
+	if len(data) < unix.SizeofRtMsg {
+		return nil
+	}
+	// rtmsg: family | dst_len | src_len | tos | table | protocol | scope | type | flags
+	family, dstLen, table, kind := data[0], int(data[1]), uint32(data[4]), data[7]
+	if kind != unix.RTN_UNICAST {
+		return nil
+	}
+	bits := 8 * net.IPv4len
+	if family == unix.AF_INET6 {
+		bits = 8 * net.IPv6len
+	} else if family != unix.AF_INET {
+		return nil
+	}
+	r := Route{Dst: &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(dstLen, bits)}}
+	oif := 0
+	var multipath []byte
+	for _, a := range parseAttrs(data[unix.SizeofRtMsg:]) {
+		switch a.typ {
+		case unix.RTA_DST:
+			r.Dst.IP = copyIP(a.data)
+		case unix.RTA_GATEWAY:
+			r.Gateway = copyIP(a.data)
+		case unix.RTA_PREFSRC:
+			r.Src = copyIP(a.data)
+		case unix.RTA_PRIORITY:
+			if len(a.data) == 4 {
+				r.Metric = binary.NativeEndian.Uint32(a.data)
+			}
+		case unix.RTA_OIF:
+			if len(a.data) == 4 {
+				oif = int(binary.NativeEndian.Uint32(a.data))
+			}
+		case unix.RTA_TABLE:
+			if len(a.data) == 4 {
+				table = binary.NativeEndian.Uint32(a.data)
+			}
+		case unix.RTA_MULTIPATH:
+			multipath = a.data
+		}
+	}
+	if table != unix.RT_TABLE_MAIN || len(r.Dst.IP) != bits/8 {
+		return nil
+	}
+	if multipath == nil {
+		if oif != ifindex {
+			return nil
+		}
+		return []Route{r}
+	}
+
+	// rtnexthop: len (2) | flags | hops | ifindex (4), followed by attributes
+	var routes []Route
+	for len(multipath) >= unix.SizeofRtNexthop {
+		l := int(binary.NativeEndian.Uint16(multipath))
+		if l < unix.SizeofRtNexthop || l > len(multipath) {
+			break
+		}
+		hop := r
+		hop.Gateway = nil
+		for _, a := range parseAttrs(multipath[unix.SizeofRtNexthop:l]) {
+			if a.typ == unix.RTA_GATEWAY {
+				hop.Gateway = copyIP(a.data)
+			}
+		}
+		if int(binary.NativeEndian.Uint32(multipath[4:])) == ifindex {
+			routes = append(routes, hop)
+		}
+		multipath = multipath[min(rtaAlign(l), len(multipath)):]
+	}
+	return routes
+}
+
+type rtAttr struct {
+	typ  uint16
+	data []byte
+}
+
+// Split a sequence of rtattr: len (2) | type (2) | data, each 4 byte aligned.
+func parseAttrs(b []byte) []rtAttr {
+	var attrs []rtAttr
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs = append(attrs, rtAttr{
+			// without NLA_F_NESTED and NLA_F_NET_BYTEORDER
+			typ:  binary.NativeEndian.Uint16(b[2:]) & 0x3fff,
+			data: b[unix.SizeofRtAttr:l],
+		})
+		b = b[min(rtaAlign(l), len(b)):]
+	}
+	return attrs
+}
+
+func rtaAlign(l int) int {
+	return (l + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
+
+// netlink buffers are reused
+func copyIP(b []byte) net.IP {
+	return append(net.IP(nil), b...)
+}
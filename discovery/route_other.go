@@ -0,0 +1,18 @@
+//go:build !linux
+
+package discovery
+
+import (
+	"errors"
+)
+
+var errNoNetlink = errors.New("routing table is linux only")
+
+func listRoutes(ifindex int) ([]Route, error) {
+	return nil, errNoNetlink
+}
+
+// Linux only, see Routes.
+func (n *Network) WatchRoutes(size int) (<-chan RouteEvent, func(), error) {
+	return nil, nil, errNoNetlink
+}
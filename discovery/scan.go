@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// pause between two ARP requests of a scan
+	ARPScanRate = time.Millisecond * 5
+	// how long a scan waits for late replies after the last request, unless
+	// the context is done earlier
+	ARPScanTimeout = time.Second * 2
+)
+
+// Don't sweep anything larger than a /16.
+const arpScanMax = 1 << 16
+
+// Sweep <cidr> (the subnet of Localhost if empty) with ARP requests and return
+// every host answering until <ctx> is done or ARPScanTimeout elapsed after the
+// last request. Replies are also added to the HostMap.
+func (n *Network) ScanARP(ctx context.Context, cidr string) ([]Host, error) {
+	var subnet *net.IPNet
+	var err error
+	if cidr == "" {
+		subnet, err = n.Subnet()
+	} else {
+		_, subnet, err = net.ParseCIDR(cidr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, errors.New("only ipv4")
+	}
+	ones, bits := subnet.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+	if size > arpScanMax {
+		return nil, errors.New("subnet too large")
+	}
+
+	var lock sync.Mutex
+	found := make(map[string]Host, init_size)
+	reason := ListenerReason{Class: ReplyListener, Name: "arp scan " + subnet.String()}
+	listener, err := n.Listeners.Add(reason, func(pkt gopacket.Packet) {
+		arplayer := pkt.Layer(layers.LayerTypeARP)
+		if arplayer == nil {
+			return
+		}
+		arp := arplayer.(*layers.ARP)
+		if arp.Operation != layers.ARPReply ||
+			!bytes.Equal(arp.DstHwAddress, n.Localhost.Mac) ||
+			!subnet.Contains(arp.SourceProtAddress) {
+			return
+		}
+		h := Host{
+			Addr: append(net.IP(nil), arp.SourceProtAddress...),
+			Mac:  append(net.HardwareAddr(nil), arp.SourceHwAddress...),
+		}
+		n.hosts.Update(&h)
+		lock.Lock()
+		found[h.Addr.String()] = h
+		lock.Unlock()
+	}, LayerFilter(layers.LayerTypeARP))
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Remove()
+	log.Printf("[+] scanning %v", subnet)
+
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	ticker := time.NewTicker(ARPScanRate)
+	defer ticker.Stop()
+	for i := uint64(0); i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			// network and broadcast address
+			continue
+		}
+		target := make(net.IP, 4)
+		binary.BigEndian.PutUint32(target, base+uint32(i))
+		if target.Equal(n.Localhost.Addr) {
+			continue
+		}
+		if err := n.requestARP(target); err != nil {
+			log.Printf("write err: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return scanned(&lock, found), nil
+		}
+	}
+
+	timer := time.NewTimer(ARPScanTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return scanned(&lock, found), nil
+}
+
+func scanned(lock *sync.Mutex, found map[string]Host) []Host {
+	lock.Lock()
+	defer lock.Unlock()
+	hosts := make([]Host, 0, len(found))
+	for _, h := range found {
+		hosts = append(hosts, h)
+	}
+	log.Printf("[+] scan: %d hosts", len(hosts))
+	return hosts
+}
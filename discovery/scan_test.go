@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"context"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"testing"
+	"time"
+)
+
+func TestScanARP(t *testing.T) {
+	defer func(timeout time.Duration) { ARPScanTimeout = timeout }(ARPScanTimeout)
+	ARPScanTimeout = time.Millisecond * 200
+
+	lan, err := vlan.New("10.0.0.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lan.Close()
+	want := make(map[string]*vlan.Host)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.5", "10.0.0.14"} {
+		h, err := lan.AddHost("host "+ip, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[ip] = h
+	}
+	pio, mac, addr, err := lan.Tap("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetworkIO(pio, "vlan", Host{Mac: mac}, addr)
+	defer n.Close()
+
+	found, err := n.ScanARP(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(want) {
+		t.Errorf("found %v", found)
+	}
+	for _, h := range found {
+		if w, exists := want[h.Addr.String()]; !exists || w.Mac.String() != h.Mac.String() {
+			t.Errorf("unexpected %v", h.String())
+		}
+		if n.HostMap().GetIP(h.Addr.String()) == nil {
+			t.Errorf("%v not in HostMap", h.String())
+		}
+	}
+	// the sweep taught the hosts our address
+	if !want["10.0.0.5"].WaitARP("10.0.0.2", mac, time.Second) {
+		t.Errorf("ARP cache: %v", want["10.0.0.5"].ARPCache())
+	}
+}
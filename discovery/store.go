@@ -0,0 +1,297 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the hosts of all attached Networks are written every StoreFlushRate, so
+// LastSeen stays current
+var StoreFlushRate = time.Minute
+
+// bucket layout:
+//
+//	<network>/hosts/<mac> -> storedHost
+//	<network>/history/<mac>/<ip> -> AddrRecord
+var (
+	storeHosts   = []byte("hosts")
+	storeHistory = []byte("history")
+)
+
+// An address a MAC had at some point.
+type AddrRecord struct {
+	Addr      net.IP
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+type storedHost struct {
+	Mac       string
+	Addrs     []string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Meta      HostMeta
+}
+
+// On-disk host inventory, one per file, holding any number of networks.
+type Store struct {
+	db *bolt.DB
+
+	lock     sync.Mutex
+	attached []*attachment
+}
+
+type attachment struct {
+	key    string
+	hosts  *HostMap
+	cancel func()
+	done   chan struct{}
+}
+
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Flush and detach all networks, then close the file.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	attached := s.attached
+	s.attached = nil
+	s.lock.Unlock()
+	for _, a := range attached {
+		a.cancel()
+		<-a.done
+	}
+	return s.db.Close()
+}
+
+// Name <n> for the Store: the MAC of its gateway, as the same subnet may be
+// used by many networks.
+func NetworkKey(n *Network) (string, error) {
+	gw, err := n.Gateway()
+	if err != nil {
+		return "", err
+	}
+	return gw.Mac.String(), nil
+}
+
+// Load the hosts stored under <key> (see NetworkKey, or e.g. an SSID) into
+// <n> and persist every change from now on, until Close. Stored hosts come
+// without their addresses, which may be stale: those are learned (or
+// resolved) anew. They are not expired before they are seen again.
+func (s *Store) Attach(n *Network, key string) error {
+	hosts, err := s.Load(key)
+	if err != nil {
+		return err
+	}
+	for i := range hosts {
+		hosts[i].Addr, hosts[i].Addrs = nil, nil
+		n.hosts.restore(&hosts[i])
+	}
+	log.Printf("[+] store: %d hosts of %s loaded", len(hosts), key)
+
+	events, cancel := n.hosts.Subscribe(256)
+	a := &attachment{key: key, hosts: n.hosts, cancel: cancel, done: make(chan struct{})}
+	s.lock.Lock()
+	s.attached = append(s.attached, a)
+	s.lock.Unlock()
+	go s.persist_loop(a, events)
+	return nil
+}
+
+func (s *Store) persist_loop(a *attachment, events <-chan HostEvent) {
+	defer close(a.done)
+	ticker := time.NewTicker(StoreFlushRate)
+	defer ticker.Stop()
+	flush := func() {
+		if err := s.Save(a.key, a.hosts.Hosts()...); err != nil {
+			log.Printf("store err: %v", err)
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				flush()
+				return
+			}
+			// removed (e.g. expired) hosts stay in the inventory
+			if ev.Kind == HostRemoved {
+				continue
+			}
+			if err := s.Save(a.key, ev.Host); err != nil {
+				log.Printf("store err: %v", err)
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Write <hosts> of network <key>, recording their addresses in the history.
+// Hosts without addresses keep the ones stored before.
+func (s *Store) Save(key string, hosts ...Host) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		nb, err := tx.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		hb, err := nb.CreateBucketIfNotExists(storeHosts)
+		if err != nil {
+			return err
+		}
+		history, err := nb.CreateBucketIfNotExists(storeHistory)
+		if err != nil {
+			return err
+		}
+		for _, h := range hosts {
+			mac := []byte(h.Mac.String())
+			stored := storedHost{
+				Mac:       h.Mac.String(),
+				FirstSeen: h.FirstSeen,
+				LastSeen:  h.LastSeen,
+				Meta:      h.Meta,
+			}
+			if old := hb.Get(mac); old != nil {
+				var prev storedHost
+				if json.Unmarshal(old, &prev) == nil {
+					if stored.FirstSeen.IsZero() || prev.FirstSeen.Before(stored.FirstSeen) {
+						stored.FirstSeen = prev.FirstSeen
+					}
+					prev.Meta.merge(&h.Meta, h.Mac)
+					stored.Meta = prev.Meta
+					if len(h.Addrs) == 0 {
+						stored.Addrs = prev.Addrs
+					}
+				}
+			}
+			for _, ip := range h.Addrs {
+				stored.Addrs = append(stored.Addrs, ip.String())
+			}
+			buf, err := json.Marshal(&stored)
+			if err != nil {
+				return err
+			}
+			if err := hb.Put(mac, buf); err != nil {
+				return err
+			}
+
+			mb, err := history.CreateBucketIfNotExists(mac)
+			if err != nil {
+				return err
+			}
+			for _, ip := range h.Addrs {
+				rec := AddrRecord{Addr: ip, FirstSeen: h.LastSeen, LastSeen: h.LastSeen}
+				if old := mb.Get([]byte(ip.String())); old != nil {
+					var prev AddrRecord
+					if json.Unmarshal(old, &prev) == nil {
+						rec.FirstSeen = prev.FirstSeen
+						if prev.LastSeen.After(rec.LastSeen) {
+							rec.LastSeen = prev.LastSeen
+						}
+					}
+				}
+				buf, err := json.Marshal(&rec)
+				if err != nil {
+					return err
+				}
+				if err := mb.Put([]byte(ip.String()), buf); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// All hosts of network <key>, with their last known addresses.
+func (s *Store) Load(key string) ([]Host, error) {
+	var hosts []Host
+	err := s.db.View(func(tx *bolt.Tx) error {
+		nb := tx.Bucket([]byte(key))
+		if nb == nil {
+			return nil
+		}
+		hb := nb.Bucket(storeHosts)
+		if hb == nil {
+			return nil
+		}
+		return hb.ForEach(func(_, v []byte) error {
+			var stored storedHost
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			mac, err := net.ParseMAC(stored.Mac)
+			if err != nil {
+				return err
+			}
+			h := Host{
+				Mac:       mac,
+				FirstSeen: stored.FirstSeen,
+				LastSeen:  stored.LastSeen,
+				Meta:      stored.Meta,
+			}
+			for _, a := range stored.Addrs {
+				if ip := net.ParseIP(a); ip != nil {
+					h.AddAddr(ip)
+				}
+			}
+			hosts = append(hosts, h)
+			return nil
+		})
+	})
+	return hosts, err
+}
+
+// Every address <mac> had on network <key>, oldest first.
+func (s *Store) History(key string, mac net.HardwareAddr) ([]AddrRecord, error) {
+	var records []AddrRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		nb := tx.Bucket([]byte(key))
+		if nb == nil {
+			return errors.New("no such network")
+		}
+		history := nb.Bucket(storeHistory)
+		if history == nil {
+			return nil
+		}
+		mb := history.Bucket([]byte(mac.String()))
+		if mb == nil {
+			return nil
+		}
+		return mb.ForEach(func(_, v []byte) error {
+			var rec AddrRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].FirstSeen.Before(records[j].FirstSeen)
+	})
+	return records, err
+}
+
+// Keys of all stored networks.
+func (s *Store) Networks() ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			keys = append(keys, string(name))
+			return nil
+		})
+	})
+	return keys, err
+}
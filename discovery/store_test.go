@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "hosts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:0a")
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := Host{Mac: mac, FirstSeen: first, LastSeen: first, Meta: HostMeta{Hostname: "box"}}
+	h.AddAddr(net.ParseIP("10.0.0.1"))
+	if err := s.Save("gw", h); err != nil {
+		t.Fatal(err)
+	}
+	h = Host{Mac: mac, LastSeen: first.Add(time.Hour)}
+	h.AddAddr(net.ParseIP("10.0.0.2"))
+	if err := s.Save("gw", h); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := s.Load("gw")
+	if err != nil || len(hosts) != 1 {
+		t.Fatalf("Load: %v %v", hosts, err)
+	}
+	if got := hosts[0]; !got.FirstSeen.Equal(first) || got.Meta.Hostname != "box" || !got.Addr.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Load: %+v", got)
+	}
+	history, err := s.History("gw", mac)
+	if err != nil || len(history) != 2 || !history[0].Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("History: %v %v", history, err)
+	}
+	if keys, _ := s.Networks(); len(keys) != 1 || keys[0] != "gw" {
+		t.Errorf("Networks: %v", keys)
+	}
+}
+
+func TestStoreAttach(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "hosts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	mac, _ := net.ParseMAC("02:00:00:00:00:0a")
+	h := Host{Mac: mac, Meta: HostMeta{Hostname: "box"}}
+	h.AddAddr(net.ParseIP("10.0.0.1"))
+	if err := s.Save("gw", h); err != nil {
+		t.Fatal(err)
+	}
+
+	n := newNetwork(nil, &net.Interface{Name: "test"}, Host{}, nil)
+	if err := s.Attach(n, "gw"); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.HostMap().GetMac(mac); got == nil || got.Meta.Hostname != "box" {
+		t.Errorf("not loaded: %+v", got)
+	}
+	// maybe stale, to be resolved again
+	if got := n.HostMap().GetIP("10.0.0.1"); got != nil {
+		t.Errorf("stored address trusted: %+v", got)
+	}
+	if err := s.Save("gw", Host{Mac: mac}); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, _ := s.Load("gw"); len(hosts) != 1 || !hosts[0].Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("stored address lost: %+v", hosts)
+	}
+}
+
+func TestStoreAttachExpire(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "hosts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	mac, _ := net.ParseMAC("02:00:00:00:00:0a")
+	old := time.Now().Add(-24 * time.Hour)
+	h := Host{Mac: mac, Meta: HostMeta{Hostname: "box"}, FirstSeen: old, LastSeen: old}
+	if err := s.Save("gw", h); err != nil {
+		t.Fatal(err)
+	}
+
+	n := newNetwork(nil, &net.Interface{Name: "test"}, Host{}, nil)
+	if err := s.Attach(n, "gw"); err != nil {
+		t.Fatal(err)
+	}
+	if expired := n.HostMap().Expire(HostTTL); len(expired) != 0 {
+		t.Errorf("expired before seen again: %+v", expired)
+	}
+	got := n.HostMap().GetMac(mac)
+	if got == nil || got.Meta.Hostname != "box" || !got.FirstSeen.Equal(old) {
+		t.Fatalf("reloaded host changed: %+v", got)
+	}
+	// seen again, expired as usual from now on
+	n.HostMap().Update(&Host{Mac: mac, LastSeen: old})
+	if expired := n.HostMap().Expire(HostTTL); len(expired) != 1 {
+		t.Errorf("seen host not expired: %+v", expired)
+	}
+}
@@ -0,0 +1,292 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type AlertKind uint8
+
+const (
+	// an ARP packet contradicts a known IP -> MAC binding
+	AlertARPChanged AlertKind = iota
+	// too many gratuitous ARPs from a single MAC
+	AlertARPFlood
+	// more than one DHCP server answers
+	AlertDHCPServer
+	// router advertisement from an unknown router
+	AlertRogueRA
+	// an IPv6 address is claimed by more than one MAC
+	AlertDuplicateIPv6
+)
+
+func (k AlertKind) String() string {
+	switch k {
+	case AlertARPChanged:
+		return "arp-changed"
+	case AlertARPFlood:
+		return "arp-flood"
+	case AlertDHCPServer:
+		return "dhcp-server"
+	case AlertRogueRA:
+		return "rogue-ra"
+	case AlertDuplicateIPv6:
+		return "duplicate-ipv6"
+	}
+	return fmt.Sprintf("AlertKind(%d)", uint8(k))
+}
+
+// Something that looks like spoofing.
+type Alert struct {
+	Time time.Time
+	Kind AlertKind
+	// address concerned and the MAC now claiming it
+	Addr net.IP
+	Mac  net.HardwareAddr
+	// MAC that held Addr before, if any
+	Old net.HardwareAddr
+	Msg string
+}
+
+func (a *Alert) String() string {
+	s := a.Kind.String() + ": " + a.Addr.String() + " @ " + a.Mac.String()
+	if a.Old != nil {
+		s += " (was " + a.Old.String() + ")"
+	}
+	if a.Msg != "" {
+		s += ": " + a.Msg
+	}
+	return s
+}
+
+// Passively watches a Network for ARP/NDP/DHCP spoofing, i.e. what package
+// spoof does, and reports it on Alerts. Never sends a packet.
+type Watchdog struct {
+	// alerts are dropped (but still logged) if nobody reads them
+	Alerts chan Alert
+	// legitimate routers (RA) and DHCP servers; if empty, the first one seen
+	// is trusted
+	Routers     []net.HardwareAddr
+	DHCPServers []net.IP
+	// more than FloodThreshold gratuitous ARPs per FloodWindow is a flood
+	FloodThreshold int
+	FloodWindow    time.Duration
+
+	net      *Network
+	listener *Listener
+	lock     sync.Mutex
+	// gratuitous ARPs per MAC in the current window
+	garp      map[string]int
+	garpStart time.Time
+	// IPv4 address -> MAC, learned from ARP; not the HostMap, which the
+	// passive listener may update with a spoofed binding before we see it
+	ipv4 map[string]net.HardwareAddr
+	// IPv6 address -> MAC, learned from NDP
+	ndp map[string]net.HardwareAddr
+	// alerts sent already, to report each finding once
+	reported map[string]bool
+}
+
+func NewWatchdog(n *Network) *Watchdog {
+	return &Watchdog{
+		Alerts:         make(chan Alert, 64),
+		FloodThreshold: 10,
+		FloodWindow:    time.Second * 10,
+		net:            n,
+		garp:           make(map[string]int, init_size),
+		ipv4:           make(map[string]net.HardwareAddr, init_size),
+		ndp:            make(map[string]net.HardwareAddr, init_size),
+		reported:       make(map[string]bool, init_size),
+	}
+}
+
+var watchdogReason = ListenerReason{Class: PassiveListener, Name: "watchdog"}
+
+// Start watching, trusting the IPv4 bindings known so far.
+func (w *Watchdog) Start() (err error) {
+	w.lock.Lock()
+	for _, h := range w.net.Hosts() {
+		if ip4 := h.Addr.To4(); ip4 != nil && h.Mac != nil {
+			w.ipv4[ip4.String()] = h.Mac
+		}
+	}
+	w.lock.Unlock()
+	w.listener, err = w.net.Listeners.Add(watchdogReason, w.watch)
+	return err
+}
+
+func (w *Watchdog) Stop() {
+	w.listener.Remove()
+}
+
+func (w *Watchdog) watch(pkt gopacket.Packet) {
+	if l := pkt.Layer(layers.LayerTypeARP); l != nil {
+		w.arp(l.(*layers.ARP))
+	}
+	if l := pkt.Layer(layers.LayerTypeDHCPv4); l != nil {
+		w.dhcp(l.(*layers.DHCPv4))
+	}
+	if l := pkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement); l != nil {
+		w.ra(pkt)
+	}
+	if l := pkt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement); l != nil {
+		na := l.(*layers.ICMPv6NeighborAdvertisement)
+		if mac := ndpLinkAddr(pkt, na.Options); mac != nil {
+			w.claim(na.TargetAddress, mac, "")
+		}
+	}
+	if l := pkt.Layer(layers.LayerTypeICMPv6NeighborSolicitation); l != nil {
+		ip, ok := pkt.NetworkLayer().(*layers.IPv6)
+		eth, isEth := pkt.LinkLayer().(*layers.Ethernet)
+		if ok && isEth && ip.SrcIP.IsUnspecified() {
+			// DAD probe: somebody is about to configure the target
+			ns := l.(*layers.ICMPv6NeighborSolicitation)
+			w.claim(ns.TargetAddress, eth.SrcMAC, "duplicate address detection")
+		}
+	}
+}
+
+func (w *Watchdog) arp(arp *layers.ARP) {
+	ip := net.IP(arp.SourceProtAddress)
+	mac := net.HardwareAddr(arp.SourceHwAddress)
+	if ip.IsUnspecified() {
+		// ARP probe
+		return
+	}
+
+	w.lock.Lock()
+	old, known := w.ipv4[ip.String()]
+	if !known {
+		w.ipv4[ip.String()] = append(net.HardwareAddr(nil), mac...)
+	}
+	w.lock.Unlock()
+	if known && !bytes.Equal(old, mac) {
+		w.alert(Alert{Kind: AlertARPChanged, Addr: ip, Mac: mac, Old: old})
+	}
+
+	broadcast := bytes.Equal(arp.DstHwAddress, layers.EthernetBroadcast)
+	if !bytes.Equal(arp.SourceProtAddress, arp.DstProtAddress) &&
+		!(arp.Operation == layers.ARPReply && broadcast) {
+		return
+	}
+	// gratuitous ARP
+	w.lock.Lock()
+	now := time.Now()
+	if now.Sub(w.garpStart) > w.FloodWindow {
+		w.garp = make(map[string]int, init_size)
+		w.garpStart = now
+	}
+	w.garp[mac.String()]++
+	flood := w.garp[mac.String()] == w.FloodThreshold+1
+	w.lock.Unlock()
+	if flood {
+		w.alert(Alert{Kind: AlertARPFlood, Addr: ip, Mac: mac,
+			Msg: fmt.Sprintf("more than %d in %v", w.FloodThreshold, w.FloodWindow)})
+	}
+}
+
+func (w *Watchdog) dhcp(dhcp *layers.DHCPv4) {
+	if dhcp.Operation != layers.DHCPOpReply {
+		return
+	}
+	var server net.IP
+	for _, o := range dhcp.Options {
+		if o.Type == layers.DHCPOptServerID && len(o.Data) == 4 {
+			server = net.IP(o.Data)
+		}
+	}
+	if server == nil {
+		return
+	}
+	w.lock.Lock()
+	known := len(w.DHCPServers) == 0
+	for _, s := range w.DHCPServers {
+		if s.Equal(server) {
+			known = true
+		}
+	}
+	if len(w.DHCPServers) == 0 {
+		w.DHCPServers = append(w.DHCPServers, append(net.IP(nil), server...))
+	}
+	w.lock.Unlock()
+	if !known {
+		w.alert(Alert{Kind: AlertDHCPServer, Addr: server,
+			Msg: fmt.Sprintf("offered %v to %v", dhcp.YourClientIP, dhcp.ClientHWAddr)})
+	}
+}
+
+func (w *Watchdog) ra(pkt gopacket.Packet) {
+	eth, ok := pkt.LinkLayer().(*layers.Ethernet)
+	if !ok {
+		return
+	}
+	src := pkt.NetworkLayer().NetworkFlow().Src().Raw()
+	w.lock.Lock()
+	known := len(w.Routers) == 0
+	for _, r := range w.Routers {
+		if bytes.Equal(r, eth.SrcMAC) {
+			known = true
+		}
+	}
+	if len(w.Routers) == 0 {
+		w.Routers = append(w.Routers, append(net.HardwareAddr(nil), eth.SrcMAC...))
+	}
+	w.lock.Unlock()
+	if !known {
+		w.alert(Alert{Kind: AlertRogueRA, Addr: src, Mac: eth.SrcMAC})
+	}
+}
+
+// <mac> claims to own <ip>
+func (w *Watchdog) claim(ip net.IP, mac net.HardwareAddr, msg string) {
+	w.lock.Lock()
+	old, known := w.ndp[ip.String()]
+	if !known {
+		w.ndp[ip.String()] = append(net.HardwareAddr(nil), mac...)
+	}
+	w.lock.Unlock()
+	if known && !bytes.Equal(old, mac) {
+		w.alert(Alert{Kind: AlertDuplicateIPv6, Addr: ip, Mac: mac, Old: old, Msg: msg})
+	}
+}
+
+// report <a> once
+func (w *Watchdog) alert(a Alert) {
+	a.Time = time.Now()
+	a.Addr = append(net.IP(nil), a.Addr...)
+	a.Mac = append(net.HardwareAddr(nil), a.Mac...)
+	key := a.Kind.String() + a.Addr.String() + a.Mac.String()
+	w.lock.Lock()
+	seen := w.reported[key]
+	w.reported[key] = true
+	w.lock.Unlock()
+	if seen && a.Kind != AlertARPFlood {
+		return
+	}
+	log.Printf("[!] %s", a.String())
+	select {
+	case w.Alerts <- a:
+	default:
+	}
+}
+
+// link-layer address option of an NDP message, falling back to the
+// Ethernet source
+func ndpLinkAddr(pkt gopacket.Packet, opts layers.ICMPv6Options) net.HardwareAddr {
+	for _, o := range opts {
+		if (o.Type == layers.ICMPv6OptSourceAddress ||
+			o.Type == layers.ICMPv6OptTargetAddress) && len(o.Data) == 6 {
+			return net.HardwareAddr(o.Data)
+		}
+	}
+	if eth, ok := pkt.LinkLayer().(*layers.Ethernet); ok {
+		return eth.SrcMAC
+	}
+	return nil
+}
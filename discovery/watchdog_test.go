@@ -0,0 +1,211 @@
+package discovery
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchdogARPChanged(t *testing.T) {
+	ours, theirs := util.Pipe()
+	defer theirs.Close()
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	_, subnet, _ := net.ParseCIDR("10.0.0.1/24")
+	// the passive listener learns every ARP packet, too
+	n := NewNetworkIO(ours, "pipe", Host{Mac: mac}, subnet)
+	defer n.Close()
+	w := NewWatchdog(n)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	ip := net.IP{10, 0, 0, 10}
+	if err := theirs.WritePacketData(testARP(t, testMac, mac, ip)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.lock.Lock()
+		_, seen := w.ipv4[ip.String()]
+		w.lock.Unlock()
+		if seen && n.HostMap().GetIP(ip.String()) != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("genuine reply not learned")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the passive listener got to the spoofed reply first
+	n.HostMap().Update(&Host{Addr: ip, Mac: spoofer})
+	if err := theirs.WritePacketData(testARP(t, spoofer, mac, ip)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case a := <-w.Alerts:
+		if a.Kind != AlertARPChanged || a.Mac.String() != spoofer.String() ||
+			a.Old.String() != testMac.String() {
+			t.Errorf("unexpected alert %v", a.String())
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("spoofed reply not reported")
+	}
+}
+
+var spoofer = net.HardwareAddr{0x52, 0x54, 0, 0, 0, 0x66}
+
+// A started Watchdog on one end of a Pipe, the other end for the test.
+func testWatchdog(t *testing.T, setup func(*Watchdog)) (*Watchdog, util.PacketIO) {
+	ours, theirs := util.Pipe()
+	t.Cleanup(func() { theirs.Close() })
+	_, subnet, _ := net.ParseCIDR("10.0.0.1/24")
+	n := NewNetworkIO(ours, "pipe", Host{Mac: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}}, subnet)
+	t.Cleanup(n.Close)
+	w := NewWatchdog(n)
+	if setup != nil {
+		setup(w)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Stop)
+	return w, theirs
+}
+
+// The first alert, which must be of <kind>.
+func expectAlert(t *testing.T, w *Watchdog, kind AlertKind) Alert {
+	t.Helper()
+	select {
+	case a := <-w.Alerts:
+		if a.Kind != kind {
+			t.Fatalf("unexpected alert %v", a.String())
+		}
+		return a
+	case <-time.After(time.Second * 2):
+		t.Fatalf("no %v alert", kind)
+	}
+	return Alert{}
+}
+
+func testWrite(t *testing.T, pio util.PacketIO, frame []byte) {
+	t.Helper()
+	if err := pio.WritePacketData(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ICMPv6 <msg> from <src> (MAC <mac>) to the all-nodes group
+func testICMPv6(t *testing.T, mac net.HardwareAddr, src net.IP, typ uint8,
+	msg gopacket.SerializableLayer) []byte {
+	return testICMPv6To(t, mac, MulticastMAC6(IPv6AllNodes), src, IPv6AllNodes, typ, msg)
+}
+
+// ICMPv6 <msg> from <src> (MAC <mac>) to <dst> (MAC <dstMac>)
+func testICMPv6To(t *testing.T, mac, dstMac net.HardwareAddr, src, dst net.IP, typ uint8,
+	msg gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      src,
+		DstIP:      dst,
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	return testFrame(t,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: dstMac, EthernetType: layers.EthernetTypeIPv6},
+		ip, icmp, msg)
+}
+
+func TestWatchdogARPFlood(t *testing.T) {
+	w, pio := testWatchdog(t, func(w *Watchdog) { w.FloodThreshold = 3 })
+	ip := net.IP{10, 0, 0, 1}
+	for i := 0; i < 3; i++ {
+		// gratuitous: source and target address are the same
+		testWrite(t, pio, testARP(t, spoofer, layers.EthernetBroadcast, ip))
+	}
+	select {
+	case a := <-w.Alerts:
+		t.Fatalf("alert below the threshold: %v", a.String())
+	case <-time.After(time.Millisecond * 100):
+	}
+	testWrite(t, pio, testARP(t, spoofer, layers.EthernetBroadcast, ip))
+	if a := expectAlert(t, w, AlertARPFlood); a.Mac.String() != spoofer.String() {
+		t.Errorf("unexpected alert %v", a.String())
+	}
+}
+
+func TestWatchdogDHCPServer(t *testing.T) {
+	w, pio := testWatchdog(t, func(w *Watchdog) {
+		w.DHCPServers = []net.IP{{10, 0, 0, 1}}
+	})
+	offer := func(server net.IP) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: server, DstIP: net.IPv4bcast}
+		udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+		udp.SetNetworkLayerForChecksum(ip)
+		return testFrame(t,
+			&layers.Ethernet{SrcMAC: testMac, DstMAC: layers.EthernetBroadcast,
+				EthernetType: layers.EthernetTypeIPv4},
+			ip, udp,
+			&layers.DHCPv4{
+				Operation:    layers.DHCPOpReply,
+				HardwareType: layers.LinkTypeEthernet,
+				HardwareLen:  6,
+				Xid:          1,
+				YourClientIP: net.IP{10, 0, 0, 20},
+				ClientHWAddr: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 3},
+				Options: layers.DHCPOptions{
+					layers.NewDHCPOption(layers.DHCPOptMessageType,
+						[]byte{byte(layers.DHCPMsgTypeOffer)}),
+					layers.NewDHCPOption(layers.DHCPOptServerID, server),
+				},
+			})
+	}
+	testWrite(t, pio, offer(net.IP{10, 0, 0, 1}))
+	testWrite(t, pio, offer(net.IP{10, 0, 0, 66}))
+	if a := expectAlert(t, w, AlertDHCPServer); !a.Addr.Equal(net.IP{10, 0, 0, 66}) {
+		t.Errorf("unexpected alert %v", a.String())
+	}
+}
+
+func TestWatchdogRogueRA(t *testing.T) {
+	w, pio := testWatchdog(t, nil)
+	ra := &layers.ICMPv6RouterAdvertisement{HopLimit: 64, RouterLifetime: 1800}
+	// the first router seen is trusted
+	testWrite(t, pio, testICMPv6(t, testMac, net.ParseIP("fe80::1"),
+		layers.ICMPv6TypeRouterAdvertisement, ra))
+	testWrite(t, pio, testICMPv6(t, spoofer, net.ParseIP("fe80::66"),
+		layers.ICMPv6TypeRouterAdvertisement, ra))
+	if a := expectAlert(t, w, AlertRogueRA); a.Mac.String() != spoofer.String() ||
+		!a.Addr.Equal(net.ParseIP("fe80::66")) {
+		t.Errorf("unexpected alert %v", a.String())
+	}
+}
+
+func TestWatchdogDuplicateIPv6(t *testing.T) {
+	w, pio := testWatchdog(t, nil)
+	target := net.ParseIP("2001:db8::10")
+	testWrite(t, pio, testICMPv6(t, testMac, net.ParseIP("fe80::2"),
+		layers.ICMPv6TypeNeighborAdvertisement,
+		&layers.ICMPv6NeighborAdvertisement{
+			Flags:         0x20, // override
+			TargetAddress: target,
+			Options: layers.ICMPv6Options{
+				{Type: layers.ICMPv6OptTargetAddress, Data: testMac},
+			},
+		}))
+	// somebody else probes for the same address
+	testWrite(t, pio, testICMPv6(t, spoofer, net.IPv6unspecified,
+		layers.ICMPv6TypeNeighborSolicitation,
+		&layers.ICMPv6NeighborSolicitation{TargetAddress: target}))
+	a := expectAlert(t, w, AlertDuplicateIPv6)
+	if a.Mac.String() != spoofer.String() || a.Old.String() != testMac.String() ||
+		a.Msg != "duplicate address detection" {
+		t.Errorf("unexpected alert %v", a.String())
+	}
+}
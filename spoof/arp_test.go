@@ -0,0 +1,69 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"testing"
+	"time"
+)
+
+func TestArp(t *testing.T) {
+	lan, err := vlan.New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lan.Close()
+	gw, err := lan.AddGateway("gw", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, err := lan.AddHost("victim", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pio, mac, addr, err := lan.Tap("10.0.0.66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := discovery.NewNetworkIO(pio, "vlan", discovery.Host{Mac: mac}, addr)
+	defer n.Close()
+
+	intercepted := make(chan struct{}, 16)
+	n.Listeners.Add(discovery.ListenerReason{Class: discovery.PassiveListener, Name: "test intercept"}, func(pkt gopacket.Packet) {
+		eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if pkt.Layer(layers.LayerTypeICMPv4) != nil && eth.DstMAC.String() == mac.String() {
+			intercepted <- struct{}{}
+		}
+	})
+
+	arp, err := NewArp(n, "10.0.0.2", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arp.InjectRate = time.Millisecond * 10
+	arp.Start()
+	if !victim.WaitARP("10.0.0.1", mac, time.Second) || !gw.WaitARP("10.0.0.2", mac, time.Second) {
+		t.Fatalf("not poisoned: %v %v", victim.ARPCache(), gw.ARPCache())
+	}
+	if err := victim.Ping("10.0.0.1", time.Millisecond*200); err == nil {
+		t.Error("ping bypassed us")
+	}
+	select {
+	case <-intercepted:
+	case <-time.After(time.Second):
+		t.Error("ping not intercepted")
+	}
+	if s := arp.Status(); s.Sent == 0 || s.Errors != 0 || len(s.Victims) != 2 {
+		t.Errorf("status: %+v", s)
+	}
+
+	arp.Stop()
+	if !victim.WaitARP("10.0.0.1", gw.Mac, time.Second) || !gw.WaitARP("10.0.0.2", victim.Mac, time.Second) {
+		t.Fatalf("not restored: %v %v", victim.ARPCache(), gw.ARPCache())
+	}
+	if err := victim.Ping("10.0.0.1", time.Second); err != nil {
+		t.Error(err)
+	}
+}
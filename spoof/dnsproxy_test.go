@@ -0,0 +1,145 @@
+package spoof
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// stand-in for the real resolver, answering every A query with 10.0.0.1
+// (and www.* with a CNAME to real.example.com. first)
+func upstream(t *testing.T) (addr string, queries *int32, stop func()) {
+	queries = new(int32)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		q := r.Question[0]
+		name := q.Name
+		if strings.HasPrefix(name, "www.") {
+			rr, _ := dns.NewRR(name + " 60 IN CNAME real.example.com.")
+			reply.Answer = append(reply.Answer, rr)
+			name = "real.example.com."
+		}
+		rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.1")
+		reply.Answer = append(reply.Answer, rr)
+		if opt := r.IsEdns0(); opt != nil {
+			reply.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		w.WriteMsg(reply)
+	})
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: handler,
+		NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), queries, func() { srv.Shutdown() }
+}
+
+func lookup(t *testing.T, network, addr, name string) *dns.Msg {
+	c := dns.Client{Net: network}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.SetEdns0(4096, false)
+	reply, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func firstA(t *testing.T, m *dns.Msg) string {
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	t.Fatalf("no A record in %v", m)
+	return ""
+}
+
+func TestDNSProxy(t *testing.T) {
+	up, queries, stop := upstream(t)
+	defer stop()
+
+	rules, err := ParseDNSRules(strings.NewReader(`
+# comment
+login.example.com 192.168.0.66
+*.ads.example.com 127.0.0.1
+real.example.com  192.168.0.67
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewDNSProxy("127.0.0.1:0", up, rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct{ net, name, want string }{
+		{"udp", "login.example.com.", "192.168.0.66"},
+		{"tcp", "x.ads.example.com.", "127.0.0.1"},
+		{"udp", "other.example.org.", "10.0.0.1"},
+		{"tcp", "www.example.com.", "192.168.0.67"},
+	} {
+		reply := lookup(t, tc.net, proxy.Addr, tc.name)
+		if got := firstA(t, reply); got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.net, tc.name, got, tc.want)
+		}
+		if reply.IsEdns0() == nil {
+			t.Errorf("%s %s: EDNS0 dropped", tc.net, tc.name)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("upstream saw %d queries, want 2", n)
+	}
+
+	// cached
+	lookup(t, "udp", proxy.Addr, "other.example.org.")
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("cache miss, upstream saw %d queries", n)
+	}
+
+	// matched, but no AAAA rule: NODATA rather than the real records
+	m := new(dns.Msg)
+	m.SetQuestion("login.example.com.", dns.TypeAAAA)
+	reply, _, err := new(dns.Client).Exchange(m, proxy.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 {
+		t.Errorf("AAAA: %v", reply)
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("AAAA forwarded, upstream saw %d queries", n)
+	}
+}
+
+func TestDNSProxyStop(t *testing.T) {
+	proxy, err := NewDNSProxy("127.0.0.1:0", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never started
+	proxy.Stop()
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewDNSProxy(proxy.Addr, "127.0.0.1")
+	if err := other.Start(); err == nil {
+		t.Error("started twice on the same port")
+	}
+	other.Stop()
+	proxy.Stop()
+	proxy.Stop()
+}
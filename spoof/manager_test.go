@@ -0,0 +1,127 @@
+package spoof
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start and Stop calls of all fakeSpoofs, in order.
+type calls struct {
+	lock sync.Mutex
+	list []string
+}
+
+func (c *calls) add(call string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.list = append(c.list, call)
+}
+
+// all calls since the last take
+func (c *calls) take() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	list := c.list
+	c.list = nil
+	return list
+}
+
+type fakeSpoof struct {
+	stats
+	name     string
+	calls    *calls
+	startErr error
+}
+
+func (f *fakeSpoof) Start() error {
+	f.calls.add("start " + f.name)
+	return f.startErr
+}
+
+func (f *fakeSpoof) Stop() {
+	f.calls.add("stop " + f.name)
+}
+
+func TestManager(t *testing.T) {
+	c := new(calls)
+	m := NewManager()
+	// checked by hand
+	m.CheckRate = time.Hour
+	m.MaxRestarts = 2
+	fakes := make([]*fakeSpoof, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		fakes[i] = &fakeSpoof{name: name, calls: c}
+		m.Add(name, fakes[i])
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.take(); !reflect.DeepEqual(got, []string{"start a", "start b", "start c"}) {
+		t.Errorf("start: %v", got)
+	}
+
+	fakes[0].count(nil)
+	m.check()
+	if got := c.take(); got != nil {
+		t.Errorf("healthy spoofers touched: %v", got)
+	}
+	for restarts := 1; restarts <= 2; restarts++ {
+		fakes[1].count(errors.New("down"))
+		m.check()
+		if got := c.take(); !reflect.DeepEqual(got, []string{"stop b", "start b"}) {
+			t.Errorf("restart %d: %v", restarts, got)
+		}
+		if st := m.Status()[1]; !st.Running || st.Restarts != restarts {
+			t.Errorf("restart %d: %+v", restarts, st)
+		}
+	}
+	fakes[1].count(errors.New("down"))
+	m.check()
+	m.check()
+	if got := c.take(); !reflect.DeepEqual(got, []string{"stop b"}) {
+		t.Errorf("give up: %v", got)
+	}
+	if st := m.Status()[1]; st.Running || st.Restarts != 2 {
+		t.Errorf("give up: %+v", st)
+	}
+
+	m.Stop()
+	m.Stop()
+	if got := c.take(); !reflect.DeepEqual(got, []string{"stop c", "stop a"}) {
+		t.Errorf("stop: %v", got)
+	}
+	for _, st := range m.Status() {
+		if st.Running {
+			t.Errorf("still running: %+v", st)
+		}
+	}
+}
+
+func TestManagerRollback(t *testing.T) {
+	c := new(calls)
+	m := NewManager()
+	m.Add("a", &fakeSpoof{name: "a", calls: c})
+	m.Add("b", &fakeSpoof{name: "b", calls: c})
+	m.Add("c", &fakeSpoof{name: "c", calls: c, startErr: errors.New("nope")})
+	m.Add("d", &fakeSpoof{name: "d", calls: c})
+	if err := m.Start(); err == nil {
+		t.Fatal("started")
+	}
+	want := []string{"start a", "start b", "start c", "stop b", "stop a"}
+	if got := c.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, st := range m.Status() {
+		if st.Running {
+			t.Errorf("still running: %+v", st)
+		}
+	}
+	// nothing to stop
+	m.Stop()
+	if got := c.take(); got != nil {
+		t.Errorf("stop: %v", got)
+	}
+}
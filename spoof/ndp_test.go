@@ -0,0 +1,69 @@
+package spoof
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNDP(t *testing.T) {
+	ours, theirs := util.Pipe()
+	defer theirs.Close()
+	packets := capture(t, theirs)
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 0x66}
+	n := discovery.NewNetworkIO(ours, "pipe", discovery.Host{Mac: mac},
+		&net.IPNet{IP: net.IP{10, 0, 0, 66}, Mask: net.CIDRMask(24, 32)})
+	defer n.Close()
+
+	// dual-stack, so their primary addresses are IPv4
+	victim := discovery.Host{Addr: net.IP{10, 0, 0, 2}, Mac: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2}}
+	victim.AddAddr(net.ParseIP("fe80::2"))
+	router := discovery.Host{Addr: net.IP{10, 0, 0, 1}, Mac: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}}
+	router.AddAddr(net.ParseIP("fe80::1"))
+	n.HostMap().Update(&victim)
+	n.HostMap().Update(&router)
+
+	ndp, err := NewNDP(n, "fe80::2", "fe80::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ndp.InjectRate = time.Millisecond * 10
+	// <dst> is told that <target> is at <lladdr>
+	advertised := func(dst discovery.Host, dstIP, target string, lladdr net.HardwareAddr) bool {
+		return expect(packets, time.Second, func(pkt gopacket.Packet) bool {
+			eth, _ := pkt.LinkLayer().(*layers.Ethernet)
+			ip, _ := pkt.NetworkLayer().(*layers.IPv6)
+			l := pkt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement)
+			if eth == nil || ip == nil || l == nil {
+				return false
+			}
+			na := l.(*layers.ICMPv6NeighborAdvertisement)
+			return bytes.Equal(eth.DstMAC, dst.Mac) && ip.DstIP.Equal(net.ParseIP(dstIP)) &&
+				na.TargetAddress.Equal(net.ParseIP(target)) && len(na.Options) == 1 &&
+				bytes.Equal(na.Options[0].Data, lladdr)
+		}) != nil
+	}
+
+	ndp.Start()
+	if !advertised(victim, "fe80::2", "fe80::1", mac) {
+		t.Error("victim not poisoned")
+	}
+	if !advertised(router, "fe80::1", "fe80::2", mac) {
+		t.Error("router not poisoned")
+	}
+	ndp.Stop()
+	if !advertised(victim, "fe80::2", "fe80::1", router.Mac) {
+		t.Error("victim not restored")
+	}
+	if !advertised(router, "fe80::1", "fe80::2", victim.Mac) {
+		t.Error("router not restored")
+	}
+	if s := ndp.Status(); len(s.Victims) != 2 || s.Victims[0] != "fe80::1" {
+		t.Errorf("status: %+v", s)
+	}
+}
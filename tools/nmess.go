@@ -1,9 +1,12 @@
 // Simple cmd-line client using the netmess library.
+// usage: nmess <dev> [cidr]
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"time"
 	"github.com/tinygoprogs/netmess/discovery"
 )
 
@@ -14,18 +17,28 @@ func main() {
 	}
 	defer homenet.Close()
 
-	router, err := homenet.GetHostByIP("192.168.0.1")
+	cidr := ""
+	if len(os.Args) > 2 {
+		cidr = os.Args[2]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	hosts, err := homenet.ScanARP(ctx, cidr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	println("router: ", router.String())
+	for _, h := range hosts {
+		println("host: ", h.String())
+	}
 
-	ip := "192.168.0.6"
-	someone, err := homenet.GetHostByIP(ip)
+	routes, err := homenet.Routes()
 	if err != nil {
 		log.Fatal(err)
 	}
-	println("someone: ", someone.String())
-
-	os.Exit(0)
+	for _, r := range routes {
+		println("route: ", r.String())
+	}
+	if router, err := homenet.Gateway(); err == nil {
+		println("router: ", router.String())
+	}
 }
@@ -0,0 +1,199 @@
+package util
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// TPACKET_V3 ring geometry: 8 blocks of 1MB, retired by the kernel after
+// 50ms even if not full, so packets don't linger
+const (
+	ringBlockSize = 1 << 20
+	ringBlocks    = 8
+	ringFrameSize = 1 << 11
+	ringTimeout   = 50
+)
+
+// offset of the TpacketHdrV1 in a block, see TpacketBlockDesc
+const blockHdrOffset = 8
+
+// Sniff and inject on a Linux AF_PACKET socket, reading through a
+// memory-mapped TPACKET_V3 ring. Works without cgo and libpcap.
+type AFPacket struct {
+	fd   int
+	link layers.LinkType
+	dev  int
+
+	// guards the ring and the read position, Close takes it too
+	lock   sync.Mutex
+	ring   []byte
+	block  int
+	offset uint32
+	left   uint32
+	closed bool
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// Sniff on <dev>, promiscuous. Needs CAP_NET_RAW.
+func OpenAFPacket(dev string) (*AFPacket, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	a := &AFPacket{fd: fd, dev: ifi.Index, link: layers.LinkTypeEthernet}
+	if err := a.setup(ifi); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AFPacket) setup(ifi *net.Interface) error {
+	if err := unix.SetsockoptInt(a.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return err
+	}
+	req := unix.TpacketReq3{
+		Block_size:     ringBlockSize,
+		Block_nr:       ringBlocks,
+		Frame_size:     ringFrameSize,
+		Frame_nr:       ringBlockSize / ringFrameSize * ringBlocks,
+		Retire_blk_tov: ringTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(a.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return err
+	}
+	ring, err := unix.Mmap(a.fd, 0, ringBlockSize*ringBlocks,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	a.ring = ring
+	err = unix.Bind(a.fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index})
+	if err != nil {
+		return err
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_PROMISC}
+	return unix.SetsockoptPacketMreq(a.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq)
+}
+
+func (a *AFPacket) blockHdr() *unix.TpacketHdrV1 {
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&a.ring[a.block*ringBlockSize+blockHdrOffset]))
+}
+
+func (a *AFPacket) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		a.lock.Lock()
+		if a.closed {
+			a.lock.Unlock()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		hdr := a.blockHdr()
+		if a.left == 0 {
+			if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+				a.lock.Unlock()
+				// wake up now and then to notice Close
+				fds := []unix.PollFd{{Fd: int32(a.fd), Events: unix.POLLIN | unix.POLLERR}}
+				unix.Poll(fds, 100)
+				continue
+			}
+			a.left, a.offset = hdr.Num_pkts, hdr.Offset_to_first_pkt
+			if a.left == 0 {
+				a.release(hdr)
+				a.lock.Unlock()
+				continue
+			}
+		}
+
+		start := a.block*ringBlockSize + int(a.offset)
+		pkt := (*unix.Tpacket3Hdr)(unsafe.Pointer(&a.ring[start]))
+		data := make([]byte, pkt.Snaplen)
+		copy(data, a.ring[start+int(pkt.Mac):])
+		ci := gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(pkt.Sec), int64(pkt.Nsec)),
+			CaptureLength:  int(pkt.Snaplen),
+			Length:         int(pkt.Len),
+			InterfaceIndex: a.dev,
+		}
+		a.offset += pkt.Next_offset
+		a.left--
+		if a.left == 0 {
+			a.release(hdr)
+		}
+		a.lock.Unlock()
+		return data, ci, nil
+	}
+}
+
+// hand the current block back to the kernel, called with lock held
+func (a *AFPacket) release(hdr *unix.TpacketHdrV1) {
+	atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+	a.block = (a.block + 1) % ringBlocks
+}
+
+func (a *AFPacket) WritePacketData(data []byte) error {
+	_, err := unix.Write(a.fd, data)
+	return err
+}
+
+func (a *AFPacket) SetBPFFilter(expr string) error {
+	if expr == "" {
+		return a.SetBPF(nil)
+	}
+	raw, err := CompileBPF(a.link, expr)
+	if err != nil {
+		return err
+	}
+	return a.SetBPF(raw)
+}
+
+// Attach a compiled filter program to the socket, nil to detach. Packets
+// already in the ring are still read.
+func (a *AFPacket) SetBPF(raw []bpf.RawInstruction) error {
+	if len(raw) == 0 {
+		err := unix.SetsockoptInt(a.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+		if err == unix.ENOENT {
+			// nothing attached
+			return nil
+		}
+		return err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.SetsockoptSockFprog(a.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+}
+
+func (a *AFPacket) LinkType() layers.LinkType {
+	return a.link
+}
+
+func (a *AFPacket) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	if a.ring != nil {
+		unix.Munmap(a.ring)
+		a.ring = nil
+	}
+	unix.Close(a.fd)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package util
+
+import (
+	"errors"
+	"golang.org/x/net/bpf"
+)
+
+var errNoAFPacket = errors.New("AF_PACKET is linux only")
+
+// Linux only, see OpenLive.
+type AFPacket struct {
+	PacketIO
+}
+
+func OpenAFPacket(dev string) (*AFPacket, error) {
+	return nil, errNoAFPacket
+}
+
+func (a *AFPacket) SetBPF(raw []bpf.RawInstruction) error {
+	return errNoAFPacket
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+)
+
+// Packets of a pcap or pcapng file, read without libpcap.
+type File struct {
+	f      *os.File
+	src    gopacket.PacketDataSource
+	link   layers.LinkType
+	filter bpfFilter
+}
+
+func OpenFile(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	file := File{f: f}
+	if binary.BigEndian.Uint32(magic) == 0x0a0d0d0a {
+		// pcapng section header block
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		file.src, file.link = ng, ng.LinkType()
+	} else {
+		plain, err := pcapgo.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		file.src, file.link = plain, plain.LinkType()
+	}
+	return &file, nil
+}
+
+func (f *File) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := f.src.ReadPacketData()
+		if err == io.ErrUnexpectedEOF {
+			// truncated capture
+			err = io.EOF
+		}
+		if err != nil || f.filter.match(data) {
+			return data, ci, err
+		}
+	}
+}
+
+func (f *File) WritePacketData(data []byte) error {
+	return ErrReadOnly
+}
+
+func (f *File) SetBPFFilter(expr string) error {
+	return f.filter.set(f.link, expr)
+}
+
+func (f *File) LinkType() layers.LinkType {
+	return f.link
+}
+
+func (f *File) Close() {
+	f.f.Close()
+}
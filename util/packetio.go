@@ -0,0 +1,75 @@
+// Capture plumbing: where the packets of a discovery.Network come from and go
+// to.
+package util
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"sync"
+)
+
+// Something to sniff and inject packets on.
+type PacketIO interface {
+	// Next packet; io.EOF after the last one, e.g. at the end of a file or
+	// once closed.
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	// only read packets matching <expr> (tcpdump syntax), "" to read all
+	SetBPFFilter(expr string) error
+	LinkType() layers.LinkType
+	Close()
+}
+
+var ErrReadOnly = errors.New("read only")
+
+// snap length of all PacketIOs
+const snaplen = 0xffff
+
+// Filter for PacketIOs without a kernel to run BPF.
+type bpfFilter struct {
+	lock sync.RWMutex
+	vm   *bpf.VM
+}
+
+func (f *bpfFilter) set(link layers.LinkType, expr string) error {
+	var vm *bpf.VM
+	if expr != "" {
+		raw, err := CompileBPF(link, expr)
+		if err != nil {
+			return err
+		}
+		insns, ok := bpf.Disassemble(raw)
+		if !ok {
+			return errors.New("bpf: cannot disassemble " + expr)
+		}
+		if vm, err = bpf.NewVM(insns); err != nil {
+			return err
+		}
+	}
+	f.lock.Lock()
+	f.vm = vm
+	f.lock.Unlock()
+	return nil
+}
+
+// Matcher for tcpdump expression <expr>, run in software, see CompileBPF.
+func MatchBPF(link layers.LinkType, expr string) (func(data []byte) bool, error) {
+	f := &bpfFilter{}
+	if err := f.set(link, expr); err != nil {
+		return nil, err
+	}
+	return f.match, nil
+}
+
+func (f *bpfFilter) match(data []byte) bool {
+	f.lock.RLock()
+	vm := f.vm
+	f.lock.RUnlock()
+	if vm == nil {
+		return true
+	}
+	n, err := vm.Run(data)
+	return err == nil && n > 0
+}
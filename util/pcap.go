@@ -0,0 +1,38 @@
+//go:build cgo
+
+package util
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"log"
+)
+
+// Sniff on <dev> using libpcap, promiscuous if possible.
+func OpenLive(dev string) (PacketIO, error) {
+	handle, err := pcap.OpenLive(dev, snaplen, true, pcap.BlockForever)
+	if err != nil {
+		handle, err = pcap.OpenLive(dev, snaplen, false, pcap.BlockForever)
+		if err == nil {
+			log.Printf("non promiscuous pcap on %s: %v", dev, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// Compile a tcpdump filter expression, needs libpcap.
+func CompileBPF(link layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+	insns, err := pcap.CompileBPFFilter(link, snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, ins := range insns {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return raw, nil
+}
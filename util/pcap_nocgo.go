@@ -0,0 +1,22 @@
+//go:build !cgo
+
+package util
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+var errNoLibpcap = errors.New("built without libpcap (cgo)")
+
+// Without cgo there is no libpcap, see OpenAFPacket.
+func OpenLive(dev string) (PacketIO, error) {
+	return nil, errNoLibpcap
+}
+
+// Without cgo filters can't be compiled, use AFPacket.SetBPF with a compiled
+// program (e.g. from tcpdump -dd) instead.
+func CompileBPF(link layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+	return nil, errNoLibpcap
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"sync"
+	"time"
+)
+
+// An in-memory Ethernet segment: every packet written to one port is read
+// from all others, like on a hub. Meant for tests.
+type Hub struct {
+	lock  sync.Mutex
+	ports []*HubPort
+}
+
+func NewHub() *Hub {
+	return &Hub{}
+}
+
+// Two PacketIOs connected to each other, like a cable.
+func Pipe() (*HubPort, *HubPort) {
+	h := NewHub()
+	return h.Port(), h.Port()
+}
+
+// Connect a new port. Packets queue up to 1024 deep, after that the sender
+// blocks, as long as the port is not closed.
+func (h *Hub) Port() *HubPort {
+	p := &HubPort{
+		hub:    h,
+		queue:  make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+	h.lock.Lock()
+	h.ports = append(h.ports, p)
+	h.lock.Unlock()
+	return p
+}
+
+func (h *Hub) send(from *HubPort, data []byte) {
+	h.lock.Lock()
+	ports := append([]*HubPort(nil), h.ports...)
+	h.lock.Unlock()
+	for _, p := range ports {
+		if p == from {
+			continue
+		}
+		select {
+		case p.queue <- append([]byte(nil), data...):
+		case <-p.closed:
+		}
+	}
+}
+
+func (h *Hub) remove(port *HubPort) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, p := range h.ports {
+		if p == port {
+			h.ports = append(h.ports[:i], h.ports[i+1:]...)
+			return
+		}
+	}
+}
+
+// One end of a Hub (or Pipe), implements PacketIO with LinkTypeEthernet.
+type HubPort struct {
+	hub    *Hub
+	queue  chan []byte
+	closed chan struct{}
+	once   sync.Once
+	filter bpfFilter
+}
+
+func (p *HubPort) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		select {
+		case data := <-p.queue:
+			if !p.filter.match(data) {
+				continue
+			}
+			return data, gopacket.CaptureInfo{
+				Timestamp:     time.Now(),
+				CaptureLength: len(data),
+				Length:        len(data),
+			}, nil
+		case <-p.closed:
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+	}
+}
+
+func (p *HubPort) WritePacketData(data []byte) error {
+	select {
+	case <-p.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	p.hub.send(p, data)
+	return nil
+}
+
+func (p *HubPort) SetBPFFilter(expr string) error {
+	return p.filter.set(layers.LinkTypeEthernet, expr)
+}
+
+func (p *HubPort) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (p *HubPort) Close() {
+	p.once.Do(func() {
+		p.hub.remove(p)
+		close(p.closed)
+	})
+}
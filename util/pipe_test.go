@@ -0,0 +1,54 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	a, b, c := hub.Port(), hub.Port(), hub.Port()
+	pkt := []byte{1, 2, 3, 4}
+	if err := a.WritePacketData(pkt); err != nil {
+		t.Fatal(err)
+	}
+	pkt[0] = 0
+	for _, p := range []*HubPort{b, c} {
+		data, ci, err := p.ReadPacketData()
+		if err != nil || !bytes.Equal(data, []byte{1, 2, 3, 4}) || ci.CaptureLength != 4 {
+			t.Errorf("read %v %+v %v", data, ci, err)
+		}
+	}
+	select {
+	case <-a.queue:
+		t.Error("writer read its own packet")
+	default:
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := b.ReadPacketData()
+		done <- err
+	}()
+	b.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("read after close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read blocks after close")
+	}
+	if err := b.WritePacketData(pkt); err == nil {
+		t.Error("write after close")
+	}
+	// b is gone, c still connected
+	if err := a.WritePacketData(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := c.ReadPacketData(); err != nil || data[0] != 0 {
+		t.Errorf("read %v %v", data, err)
+	}
+}
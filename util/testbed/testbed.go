@@ -0,0 +1,289 @@
+//go:build linux
+
+// Network namespaces wired into a LAN for end-to-end tests against real
+// kernels: victims and a gateway each get a namespace with an eth0 plugged
+// into a bridge, while the attacker's end of its veth stays in our namespace,
+// so discovery.NewNetwork can be used on it. Needs root and iproute2, tests
+// are skipped otherwise.
+package testbed
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// One bridge, i.e. one broadcast domain with a single IPv4 subnet.
+type Testbed struct {
+	Subnet *net.IPNet
+
+	tb testing.TB
+	// names of our namespaces and links start with it
+	prefix  string
+	bridge  string
+	nodes   []*Node
+	gateway *Node
+	links   int
+	// attacker devices in our namespace
+	devs []string
+}
+
+// A namespace plugged into the Testbed.
+type Node struct {
+	Name string
+	// network namespace, see "ip netns"
+	NS   string
+	Dev  string
+	Addr net.IP
+	Mac  net.HardwareAddr
+}
+
+// A Testbed for <cidr>, removed when <tb> is done. Skips <tb> unless we are
+// root and have iproute2.
+func New(tb testing.TB, cidr string) *Testbed {
+	tb.Helper()
+	if os.Geteuid() != 0 {
+		tb.Skip("testbed needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		tb.Skip("testbed needs iproute2")
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prefix := fmt.Sprintf("nm%d", os.Getpid()%100000)
+	b := &Testbed{Subnet: subnet, tb: tb, prefix: prefix, bridge: prefix + "-br"}
+	tb.Cleanup(b.Close)
+	b.must("netns", "add", b.bridge)
+	b.must("-n", b.bridge, "link", "add", "br0", "type", "bridge")
+	b.must("-n", b.bridge, "link", "set", "br0", "up")
+	return b
+}
+
+// Run ip <args>.
+func (b *Testbed) ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (b *Testbed) must(args ...string) {
+	b.tb.Helper()
+	if err := b.ip(args...); err != nil {
+		b.tb.Fatal(err)
+	}
+}
+
+// Connect a new veth to the bridge, its other end <dev> going to namespace
+// <ns> (a name, or a pid for the namespace of that process).
+func (b *Testbed) plug(dev, ns string) {
+	b.tb.Helper()
+	port := fmt.Sprintf("v%d", b.links)
+	b.links++
+	b.must("-n", b.bridge, "link", "add", port, "type", "veth", "peer", "name", dev, "netns", ns)
+	b.must("-n", b.bridge, "link", "set", port, "master", "br0", "up")
+}
+
+// <ip> with the mask of the Subnet, as taken by "ip addr add"
+func (b *Testbed) prefixed(ip string) string {
+	ones, _ := b.Subnet.Mask.Size()
+	return ip + "/" + strconv.Itoa(ones)
+}
+
+// A namespace routing between the Testbed and everything else, the default
+// route of all victims added afterwards.
+func (b *Testbed) AddGateway(name, ip string) *Node {
+	b.tb.Helper()
+	n := b.addNode(name, ip)
+	if err := n.Sysctl("net/ipv4/ip_forward", "1"); err != nil {
+		b.tb.Fatal(err)
+	}
+	b.gateway = n
+	return n
+}
+
+// A plain host, e.g. to be spoofed.
+func (b *Testbed) AddVictim(name, ip string) *Node {
+	b.tb.Helper()
+	return b.addNode(name, ip)
+}
+
+// Like Attacker, but in a namespace of its own, e.g. to play with its routes.
+// The code under test has to run in Node.Do; its device is named uniquely, as
+// discovery.Ifs lists the devices of our namespace.
+func (b *Testbed) AddAttacker(name, ip string) *Node {
+	b.tb.Helper()
+	dev := fmt.Sprintf("%sa%d", b.prefix, len(b.devs)+len(b.nodes))
+	return b.addNodeDev(name, ip, dev)
+}
+
+func (b *Testbed) addNode(name, ip string) *Node {
+	b.tb.Helper()
+	return b.addNodeDev(name, ip, "eth0")
+}
+
+func (b *Testbed) addNodeDev(name, ip, dev string) *Node {
+	b.tb.Helper()
+	addr := net.ParseIP(ip).To4()
+	if addr == nil || !b.Subnet.Contains(addr) {
+		b.tb.Fatalf("%s: %s not in %s", name, ip, b.Subnet)
+	}
+	n := &Node{Name: name, NS: b.prefix + "-" + name, Dev: dev, Addr: addr}
+	b.must("netns", "add", n.NS)
+	b.nodes = append(b.nodes, n)
+	b.plug(n.Dev, n.NS)
+	b.must("-n", n.NS, "addr", "add", b.prefixed(ip), "dev", n.Dev)
+	b.must("-n", n.NS, "link", "set", "lo", "up")
+	b.must("-n", n.NS, "link", "set", n.Dev, "up")
+	if b.gateway != nil {
+		b.must("-n", n.NS, "route", "add", "default", "via", b.gateway.Addr.String())
+	}
+	// by default replies within a second of the last update are ignored,
+	// which makes spoofing (and restoring) a matter of timing
+	if err := n.Sysctl("net/ipv4/neigh/"+n.Dev+"/locktime", "0"); err != nil {
+		b.tb.Fatal(err)
+	}
+	err := n.Do(func() error {
+		ifi, err := net.InterfaceByName(n.Dev)
+		if err == nil {
+			n.Mac = ifi.HardwareAddr
+		}
+		return err
+	})
+	if err != nil {
+		b.tb.Fatal(err)
+	}
+	return n
+}
+
+// A veth in our own namespace with <ip>, for the code under test. Returns
+// the device name.
+func (b *Testbed) Attacker(ip string) string {
+	b.tb.Helper()
+	dev := fmt.Sprintf("%sa%d", b.prefix, len(b.devs))
+	b.devs = append(b.devs, dev)
+	b.plug(dev, strconv.Itoa(os.Getpid()))
+	b.must("addr", "add", b.prefixed(ip), "dev", dev)
+	b.must("link", "set", dev, "up")
+	return dev
+}
+
+// Remove all namespaces and links, called automatically when the test is
+// done.
+func (b *Testbed) Close() {
+	for _, dev := range b.devs {
+		b.ip("link", "del", dev)
+	}
+	b.devs = nil
+	for _, n := range b.nodes {
+		b.ip("netns", "del", n.NS)
+	}
+	b.nodes = nil
+	b.ip("netns", "del", b.bridge)
+}
+
+// Run <f> on a thread inside the namespace of n. Sockets created by <f> stay
+// in there.
+func (n *Node) Do(f func() error) error {
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	ns, err := os.Open("/var/run/netns/" + n.NS)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	err = f()
+	if unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET) == nil {
+		runtime.UnlockOSThread()
+	}
+	// else the thread stays locked and dies with the goroutine
+	return err
+}
+
+// Write <value> to /proc/sys/<key> inside the namespace, e.g.
+// "net/ipv4/ip_forward".
+func (n *Node) Sysctl(key, value string) error {
+	return n.Do(func() error {
+		return os.WriteFile("/proc/sys/"+key, []byte(value), 0644)
+	})
+}
+
+// The kernel's ARP cache (/proc/net/arp), ip -> MAC, without incomplete
+// entries.
+func (n *Node) ARP() (map[string]net.HardwareAddr, error) {
+	cache := make(map[string]net.HardwareAddr, 8)
+	err := n.Do(func() error {
+		f, err := os.Open("/proc/thread-self/net/arp")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Scan()
+		for scanner.Scan() {
+			// ip | hw-type | flags | hw-addr | mask | device
+			cols := strings.Fields(scanner.Text())
+			if len(cols) != 6 || cols[2] == "0x0" {
+				continue
+			}
+			mac, err := net.ParseMAC(cols[3])
+			if err != nil {
+				continue
+			}
+			cache[cols[0]] = mac
+		}
+		return scanner.Err()
+	})
+	return cache, err
+}
+
+// Wait up to <timeout> for the ARP cache to map <ip> to <mac>.
+func (n *Node) WaitARP(ip string, mac net.HardwareAddr, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		cache, err := n.ARP()
+		if err == nil && cache[ip].String() == mac.String() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// Send a UDP datagram to the discard port of <ip>, e.g. to make the kernel
+// resolve it.
+func (n *Node) Touch(ip string) error {
+	return n.Do(func() error {
+		conn, err := net.Dial("udp4", net.JoinHostPort(ip, "9"))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("netmess"))
+		return err
+	})
+}
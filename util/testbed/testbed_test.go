@@ -0,0 +1,136 @@
+//go:build linux
+
+package testbed
+
+import (
+	"github.com/tinygoprogs/netmess/discovery"
+	"github.com/tinygoprogs/netmess/spoof"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestArpSpoof(t *testing.T) {
+	b := New(t, "198.18.77.0/24")
+	gw := b.AddGateway("gw", "198.18.77.1")
+	victim := b.AddVictim("victim", "198.18.77.2")
+	dev := b.Attacker("198.18.77.66")
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker := ifi.HardwareAddr
+
+	if err := victim.Touch("198.18.77.1"); err != nil {
+		t.Fatal(err)
+	}
+	if !victim.WaitARP("198.18.77.1", gw.Mac, time.Second*3) ||
+		!gw.WaitARP("198.18.77.2", victim.Mac, time.Second*3) {
+		t.Fatal("victim and gateway never talked")
+	}
+
+	n, err := discovery.NewNetwork(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	arp, err := spoof.NewArp(n, "198.18.77.2", "198.18.77.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arp.InjectRate = time.Millisecond * 100
+	arp.Start()
+	if !victim.WaitARP("198.18.77.1", attacker, time.Second*3) ||
+		!gw.WaitARP("198.18.77.2", attacker, time.Second*3) {
+		cache, _ := victim.ARP()
+		t.Fatalf("not poisoned: %v", cache)
+	}
+
+	arp.Stop()
+	if !victim.WaitARP("198.18.77.1", gw.Mac, time.Second*3) ||
+		!gw.WaitARP("198.18.77.2", victim.Mac, time.Second*3) {
+		cache, _ := victim.ARP()
+		t.Fatalf("not restored: %v", cache)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	b := New(t, "198.18.78.0/24")
+	gw := b.AddGateway("gw", "198.18.78.1")
+	b.AddVictim("backup", "198.18.78.2")
+	// routes are changed in the attacker's namespace only
+	attacker := b.AddAttacker("attacker", "198.18.78.66")
+	dev := attacker.Dev
+	b.must("-n", attacker.NS, "route", "add", "default", "via", "198.18.78.2", "dev", dev, "metric", "100")
+	b.must("-n", attacker.NS, "route", "add", "198.51.100.0/24", "nexthop", "via", "198.18.78.1", "dev", dev,
+		"nexthop", "via", "198.18.78.2", "dev", dev)
+	b.must("-n", attacker.NS, "-6", "route", "add", "2001:db8:78::/48", "dev", dev, "metric", "7")
+
+	err := attacker.Do(func() error {
+		n, err := discovery.NewNetwork(dev)
+		if err != nil {
+			return err
+		}
+		defer n.Close()
+		routes, err := n.Routes()
+		if err != nil {
+			return err
+		}
+		want := map[string]bool{
+			"198.18.78.0/24 src 198.18.78.66 metric 0": true,
+			"198.51.100.0/24 via 198.18.78.1 metric 0": true,
+			"198.51.100.0/24 via 198.18.78.2 metric 0": true,
+			"default via 198.18.78.1 metric 0":         true,
+			"default via 198.18.78.2 metric 100":       true,
+			"2001:db8:78::/48 metric 7":                true,
+		}
+		for _, r := range routes {
+			delete(want, r.String())
+		}
+		if len(want) != 0 {
+			t.Errorf("missing %v in %v", want, routes)
+		}
+		gateways, err := n.Gateways()
+		if err != nil {
+			return err
+		}
+		if len(gateways) != 2 || !gateways[0].Gateway.Equal(gw.Addr) {
+			t.Errorf("gateways %v", gateways)
+		}
+		host, err := n.Gateway()
+		if err != nil {
+			return err
+		}
+		if !host.Addr.Equal(gw.Addr) || host.Mac.String() != gw.Mac.String() {
+			t.Errorf("gateway %v, want %v %v", host.String(), gw.Addr, gw.Mac)
+		}
+
+		events, cancel, err := n.WatchRoutes(16)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		route := []string{"198.51.101.0/24", "via", "198.18.78.2", "dev", dev}
+		if err := b.ip(append([]string{"-n", attacker.NS, "route", "add"}, route...)...); err != nil {
+			return err
+		}
+		if err := b.ip(append([]string{"-n", attacker.NS, "route", "del"}, route...)...); err != nil {
+			return err
+		}
+		for _, kind := range []discovery.RouteEventKind{discovery.RouteAdded, discovery.RouteRemoved} {
+			select {
+			case ev := <-events:
+				if ev.Kind != kind || ev.Route.String() != "198.51.101.0/24 via 198.18.78.2 metric 0" {
+					t.Errorf("event %v %v, want %v", ev.Kind, ev.Route.String(), kind)
+				}
+			case <-time.After(time.Second * 3):
+				t.Errorf("no %v event", kind)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
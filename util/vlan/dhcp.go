@@ -0,0 +1,240 @@
+package vlan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+// Pool of a Host serving DHCP.
+type dhcpServer struct {
+	first, last uint32
+	// mac -> address
+	leases map[string]uint32
+}
+
+// Answer DHCP requests, handing out <first> .. <last> with the gateway of the
+// LAN (or h itself) as router and h as DNS server.
+func (h *Host) ServeDHCP(first, last string) error {
+	start, err := h.lan.addr(first)
+	if err != nil {
+		return err
+	}
+	end, err := h.lan.addr(last)
+	if err != nil {
+		return err
+	}
+	if start == nil || end == nil || ip2int(start) > ip2int(end) {
+		return errors.New("empty pool")
+	}
+	if h.Addr() == nil {
+		return errors.New("DHCP server needs an address")
+	}
+	h.lock.Lock()
+	h.dhcp = &dhcpServer{
+		first:  ip2int(start),
+		last:   ip2int(end),
+		leases: make(map[string]uint32, 16),
+	}
+	h.lock.Unlock()
+	return nil
+}
+
+// Get an address via DHCP, taking the first offer like most clients do. The
+// router handed out is used for everything outside the Subnet from then on.
+func (h *Host) RequestLease(timeout time.Duration) (net.IP, error) {
+	xid := binary.BigEndian.Uint32(h.Mac[2:])
+	h.sendDHCP(xid, layers.DHCPMsgTypeDiscover)
+	var offer *layers.DHCPv4
+	if !h.wait(timeout, func() bool {
+		offer = h.leases[xid]
+		return offer != nil
+	}) {
+		return nil, errors.New("no DHCP offer")
+	}
+	server := dhcpOptIP(offer, layers.DHCPOptServerID)
+	h.lock.Lock()
+	delete(h.leases, xid)
+	h.lock.Unlock()
+
+	h.sendDHCP(xid, layers.DHCPMsgTypeRequest,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, offer.YourClientIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID, server.To4()))
+	var ack *layers.DHCPv4
+	if !h.wait(timeout, func() bool {
+		ack = h.leases[xid]
+		return ack != nil && dhcpMsgType(ack) != layers.DHCPMsgTypeOffer
+	}) {
+		return nil, errors.New("no DHCP ack")
+	}
+	if dhcpMsgType(ack) != layers.DHCPMsgTypeAck {
+		return nil, errors.New("DHCP nak")
+	}
+	addr := append(net.IP(nil), ack.YourClientIP.To4()...)
+	h.lock.Lock()
+	h.addr = addr
+	h.router = dhcpOptIP(ack, layers.DHCPOptRouter)
+	delete(h.leases, xid)
+	h.notify()
+	h.lock.Unlock()
+	return addr, nil
+}
+
+// Router the last lease named, nil if there is none.
+func (h *Host) Router() net.IP {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.router
+}
+
+func (h *Host) sendDHCP(xid uint32, t layers.DHCPMsgType, opts ...layers.DHCPOption) {
+	opts = append(layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(t)}),
+		layers.NewDHCPOption(layers.DHCPOptHostname, []byte(h.Name)),
+	}, opts...)
+	h.sendIP(broadcast, net.IPv4bcast, layers.IPProtocolUDP,
+		&layers.UDP{SrcPort: 68, DstPort: 67},
+		&layers.DHCPv4{
+			Operation:    layers.DHCPOpRequest,
+			HardwareType: layers.LinkTypeEthernet,
+			HardwareLen:  6,
+			Xid:          xid,
+			Flags:        0x8000,
+			ClientHWAddr: h.Mac,
+			Options:      opts,
+		})
+}
+
+func (h *Host) handleDHCP(eth *layers.Ethernet, p *layers.DHCPv4) {
+	if p.Operation == layers.DHCPOpReply {
+		if !bytes.Equal(p.ClientHWAddr, h.Mac) {
+			return
+		}
+		h.lock.Lock()
+		// the first offer wins, acks overwrite it
+		if prev := h.leases[p.Xid]; prev == nil ||
+			(dhcpMsgType(prev) == layers.DHCPMsgTypeOffer && dhcpMsgType(p) != layers.DHCPMsgTypeOffer) {
+			h.leases[p.Xid] = p
+			h.notify()
+		}
+		h.lock.Unlock()
+		return
+	}
+
+	h.lock.Lock()
+	srv, addr := h.dhcp, h.addr
+	var yiaddr net.IP
+	t := layers.DHCPMsgTypeUnspecified
+	if srv != nil {
+		switch dhcpMsgType(p) {
+		case layers.DHCPMsgTypeDiscover:
+			if lease := srv.lease(p.ClientHWAddr, h); lease != 0 {
+				t, yiaddr = layers.DHCPMsgTypeOffer, int2ip(lease)
+			}
+		case layers.DHCPMsgTypeRequest:
+			if sid := dhcpOptIP(p, layers.DHCPOptServerID); sid != nil && !sid.Equal(addr) {
+				// client picked another server
+				break
+			}
+			want := dhcpOptIP(p, layers.DHCPOptRequestIP)
+			if want == nil {
+				want = p.ClientIP
+			}
+			t = layers.DHCPMsgTypeNak
+			if lease := srv.lease(p.ClientHWAddr, h); lease != 0 && lease == ip2int(want) {
+				t, yiaddr = layers.DHCPMsgTypeAck, int2ip(lease)
+			}
+		}
+	}
+	h.lock.Unlock()
+	if t == layers.DHCPMsgTypeUnspecified {
+		return
+	}
+
+	router := addr
+	if gw := h.lan.Gateway(); gw != nil && gw != h {
+		router = gw.Addr()
+	}
+	opts := layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(t)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, addr.To4()),
+	}
+	if t != layers.DHCPMsgTypeNak {
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, uint32(time.Hour/time.Second))
+		mask := h.lan.Subnet.Mask
+		opts = append(opts,
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, lease),
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, mask[len(mask)-4:]),
+			layers.NewDHCPOption(layers.DHCPOptRouter, router.To4()),
+			layers.NewDHCPOption(layers.DHCPOptDNS, addr.To4()),
+		)
+	}
+	h.sendIP(eth.SrcMAC, net.IPv4bcast, layers.IPProtocolUDP,
+		&layers.UDP{SrcPort: 67, DstPort: 68},
+		&layers.DHCPv4{
+			Operation:    layers.DHCPOpReply,
+			HardwareType: layers.LinkTypeEthernet,
+			HardwareLen:  6,
+			Xid:          p.Xid,
+			Flags:        p.Flags,
+			YourClientIP: yiaddr,
+			NextServerIP: addr,
+			ClientHWAddr: p.ClientHWAddr,
+			Options:      opts,
+		})
+}
+
+// Address of <mac>, a new one if it has none, 0 if the pool is exhausted.
+// Called with h.lock held.
+func (s *dhcpServer) lease(mac net.HardwareAddr, h *Host) uint32 {
+	if addr, exists := s.leases[mac.String()]; exists {
+		return addr
+	}
+	used := make(map[uint32]bool, len(s.leases)+1)
+	for _, addr := range s.leases {
+		used[addr] = true
+	}
+	used[ip2int(h.addr)] = true
+	for i := s.first; i <= s.last; i++ {
+		if !used[i] {
+			s.leases[mac.String()] = i
+			return i
+		}
+	}
+	return 0
+}
+
+func dhcpOptIP(p *layers.DHCPv4, t layers.DHCPOpt) net.IP {
+	for _, o := range p.Options {
+		if o.Type == t && len(o.Data) == 4 {
+			return net.IP(o.Data)
+		}
+	}
+	return nil
+}
+
+func dhcpMsgType(p *layers.DHCPv4) layers.DHCPMsgType {
+	for _, o := range p.Options {
+		if o.Type == layers.DHCPOptMessageType && len(o.Data) == 1 {
+			return layers.DHCPMsgType(o.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+func ip2int(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	return 0
+}
+
+func int2ip(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
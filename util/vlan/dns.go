@@ -0,0 +1,110 @@
+package vlan
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// Answer A queries on port 53 from <records> (name -> ip), NXDOMAIN for
+// everything else.
+func (h *Host) ServeDNS(records map[string]string) error {
+	zone := make(map[string]net.IP, len(records))
+	for name, ip := range records {
+		addr := net.ParseIP(ip).To4()
+		if addr == nil {
+			return errors.New("parsing ip " + ip)
+		}
+		zone[dns.Fqdn(strings.ToLower(name))] = addr
+	}
+	h.lock.Lock()
+	h.dns = zone
+	h.lock.Unlock()
+	return nil
+}
+
+// Ask <server> for the A record of <name>, waiting up to <timeout>.
+func (h *Host) Lookup(server, name string, timeout time.Duration) (net.IP, error) {
+	dst := net.ParseIP(server).To4()
+	if dst == nil {
+		return nil, errors.New("parsing ip")
+	}
+	mac, err := h.nextHop(dst, timeout)
+	if err != nil {
+		return nil, err
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	h.sendIP(mac, dst, layers.IPProtocolUDP,
+		&layers.UDP{SrcPort: 5353, DstPort: 53}, gopacket.Payload(buf))
+
+	var answer net.IP
+	if !h.wait(timeout, func() bool {
+		var answered bool
+		answer, answered = h.answers[query.Id]
+		return answered
+	}) {
+		return nil, errors.New("no DNS reply from " + server)
+	}
+	if answer == nil {
+		return nil, errors.New("NXDOMAIN " + name)
+	}
+	return answer, nil
+}
+
+func (h *Host) handleDNS(eth *layers.Ethernet, ip4 *layers.IPv4, udp *layers.UDP) {
+	msg := new(dns.Msg)
+	if msg.Unpack(udp.Payload) != nil {
+		return
+	}
+	if msg.Response {
+		var answer net.IP
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				answer = a.A.To4()
+				break
+			}
+		}
+		h.lock.Lock()
+		h.answers[msg.Id] = answer
+		h.notify()
+		h.lock.Unlock()
+		return
+	}
+
+	h.lock.Lock()
+	zone, addr := h.dns, h.addr
+	h.lock.Unlock()
+	if zone == nil || addr == nil || !addr.Equal(ip4.DstIP) || len(msg.Question) != 1 {
+		return
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	q := msg.Question[0]
+	if ip, exists := zone[strings.ToLower(q.Name)]; exists && q.Qtype == dns.TypeA {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		})
+	} else if !exists {
+		reply.Rcode = dns.RcodeNameError
+	}
+	buf, err := reply.Pack()
+	if err != nil {
+		return
+	}
+	mac := h.ARP(ip4.SrcIP.String())
+	if mac == nil {
+		mac = eth.SrcMAC
+	}
+	h.sendIP(mac, ip4.SrcIP, layers.IPProtocolUDP,
+		&layers.UDP{SrcPort: 53, DstPort: udp.SrcPort}, gopacket.Payload(buf))
+}
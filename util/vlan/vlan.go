@@ -0,0 +1,462 @@
+// Simulated Ethernet segment for tests: hosts with ARP caches, a gateway,
+// DHCP and DNS servers, all connected through a util.Hub, so discovery and
+// spoof code can be run without a real interface.
+package vlan
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tinygoprogs/netmess/util"
+	"net"
+	"sync"
+	"time"
+)
+
+var broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// One broadcast domain with a single IPv4 subnet.
+type LAN struct {
+	Subnet *net.IPNet
+
+	hub     *util.Hub
+	lock    sync.Mutex
+	hosts   []*Host
+	gateway *Host
+	macs    int
+}
+
+// A LAN for <cidr>, e.g. 10.0.0.0/24.
+func New(cidr string) (*LAN, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, errors.New("only ipv4")
+	}
+	return &LAN{Subnet: subnet, hub: util.NewHub()}, nil
+}
+
+// next MAC, 52:54:00:00:<n>
+func (l *LAN) mac() net.HardwareAddr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.macs++
+	return net.HardwareAddr{0x52, 0x54, 0x00, 0x00, byte(l.macs >> 8), byte(l.macs)}
+}
+
+// parse <ip>, which must be in the Subnet, "" is no address at all
+func (l *LAN) addr(ip string) (net.IP, error) {
+	if ip == "" {
+		return nil, nil
+	}
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return nil, errors.New("parsing ip")
+	}
+	if !l.Subnet.Contains(addr) {
+		return nil, errors.New(ip + " outside of " + l.Subnet.String())
+	}
+	return addr, nil
+}
+
+// Plug in a machine called <name> with address <ip>, "" to leave it
+// unconfigured (see Host.RequestLease).
+func (l *LAN) AddHost(name, ip string) (*Host, error) {
+	addr, err := l.addr(ip)
+	if err != nil {
+		return nil, err
+	}
+	h := &Host{
+		Name:    name,
+		Mac:     l.mac(),
+		lan:     l,
+		port:    l.hub.Port(),
+		addr:    addr,
+		arp:     make(map[string]net.HardwareAddr, 16),
+		changed: make(chan struct{}),
+		pongs:   make(map[uint16]bool, 4),
+		leases:  make(map[uint32]*layers.DHCPv4, 4),
+		answers: make(map[uint16]net.IP, 4),
+	}
+	l.lock.Lock()
+	l.hosts = append(l.hosts, h)
+	l.lock.Unlock()
+	go h.run()
+	return h, nil
+}
+
+// AddHost, then make it the default router: hosts send everything outside
+// the Subnet to it and it answers pings for any such address.
+func (l *LAN) AddGateway(name, ip string) (*Host, error) {
+	if ip == "" {
+		return nil, errors.New("gateway needs an address")
+	}
+	h, err := l.AddHost(name, ip)
+	if err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	l.gateway = h
+	l.lock.Unlock()
+	return h, nil
+}
+
+// The default router, nil if there is none.
+func (l *LAN) Gateway() *Host {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.gateway
+}
+
+// A raw port for the code under test, e.g. for discovery.NewNetworkIO, with a
+// fresh MAC and <ip> as address (with the mask of the Subnet).
+func (l *LAN) Tap(ip string) (util.PacketIO, net.HardwareAddr, *net.IPNet, error) {
+	addr, err := l.addr(ip)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return l.hub.Port(), l.mac(), &net.IPNet{IP: addr, Mask: l.Subnet.Mask}, nil
+}
+
+// Unplug all hosts. Taps are closed by their users.
+func (l *LAN) Close() {
+	l.lock.Lock()
+	hosts := l.hosts
+	l.hosts = nil
+	l.lock.Unlock()
+	for _, h := range hosts {
+		h.Close()
+	}
+}
+
+// A simulated machine: answers ARP requests and pings, keeps an ARP cache
+// that believes every reply and can be made a DHCP or DNS server.
+type Host struct {
+	Name string
+	Mac  net.HardwareAddr
+
+	lan  *LAN
+	port *util.HubPort
+
+	// everything below, changed is closed (and replaced) on every change
+	lock    sync.Mutex
+	changed chan struct{}
+	addr    net.IP
+	router  net.IP
+	arp     map[string]net.HardwareAddr
+	// echo id -> answered
+	pongs map[uint16]bool
+	// xid -> last DHCP reply
+	leases map[uint32]*layers.DHCPv4
+	// DNS id -> answer, nil for NXDOMAIN
+	answers map[uint16]net.IP
+	dhcp    *dhcpServer
+	dns     map[string]net.IP
+	echoID  uint16
+}
+
+func (h *Host) String() string {
+	return h.Name + " (" + h.Mac.String() + " @ " + h.Addr().String() + ")"
+}
+
+// Current IPv4 address, nil while unconfigured.
+func (h *Host) Addr() net.IP {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.addr
+}
+
+// ARP cache entry for <ip>, nil if there is none.
+func (h *Host) ARP(ip string) net.HardwareAddr {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.arp[ip]
+}
+
+// Snapshot of the ARP cache, ip -> MAC.
+func (h *Host) ARPCache() map[string]net.HardwareAddr {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	cache := make(map[string]net.HardwareAddr, len(h.arp))
+	for ip, mac := range h.arp {
+		cache[ip] = mac
+	}
+	return cache
+}
+
+// Wait up to <timeout> for the ARP cache to map <ip> to <mac>.
+func (h *Host) WaitARP(ip string, mac net.HardwareAddr, timeout time.Duration) bool {
+	return h.wait(timeout, func() bool {
+		return bytes.Equal(h.arp[ip], mac)
+	})
+}
+
+// Wait up to <timeout> for <cond> to hold, which is called with lock held.
+func (h *Host) wait(timeout time.Duration, cond func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		h.lock.Lock()
+		ok, changed := cond(), h.changed
+		h.lock.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// wake up all waiters, called with lock held
+func (h *Host) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Unplug.
+func (h *Host) Close() {
+	h.port.Close()
+}
+
+func (h *Host) run() {
+	for {
+		data, _, err := h.port.ReadPacketData()
+		if err != nil {
+			return
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		ethlayer := pkt.Layer(layers.LayerTypeEthernet)
+		if ethlayer == nil {
+			continue
+		}
+		eth := ethlayer.(*layers.Ethernet)
+		if !bytes.Equal(eth.DstMAC, h.Mac) && !bytes.Equal(eth.DstMAC, broadcast) {
+			// no promiscuous NICs here
+			continue
+		}
+		if l := pkt.Layer(layers.LayerTypeARP); l != nil {
+			h.handleARP(l.(*layers.ARP))
+			continue
+		}
+		ip4layer := pkt.Layer(layers.LayerTypeIPv4)
+		if ip4layer == nil {
+			continue
+		}
+		ip4 := ip4layer.(*layers.IPv4)
+		if l := pkt.Layer(layers.LayerTypeICMPv4); l != nil {
+			h.handleICMP(eth, ip4, l.(*layers.ICMPv4))
+		}
+		if l := pkt.Layer(layers.LayerTypeDHCPv4); l != nil {
+			h.handleDHCP(eth, l.(*layers.DHCPv4))
+		}
+		if l := pkt.Layer(layers.LayerTypeUDP); l != nil {
+			udp := l.(*layers.UDP)
+			if udp.DstPort == 53 || udp.SrcPort == 53 {
+				h.handleDNS(eth, ip4, udp)
+			}
+		}
+	}
+}
+
+// Like the stacks ARP spoofing was made for: every reply is believed,
+// requests for us (and gratuitous ones) update the cache too.
+func (h *Host) handleARP(arp *layers.ARP) {
+	sender := net.IP(arp.SourceProtAddress).To4()
+	mac := append(net.HardwareAddr(nil), arp.SourceHwAddress...)
+	if sender == nil || !h.lan.Subnet.Contains(sender) || bytes.Equal(mac, h.Mac) {
+		return
+	}
+	h.lock.Lock()
+	addr := h.addr
+	forUs := addr != nil && addr.Equal(net.IP(arp.DstProtAddress))
+	_, known := h.arp[sender.String()]
+	if arp.Operation == layers.ARPReply || forUs || known {
+		if !bytes.Equal(h.arp[sender.String()], mac) {
+			h.arp[sender.String()] = mac
+			h.notify()
+		}
+	}
+	h.lock.Unlock()
+
+	if arp.Operation == layers.ARPRequest && forUs {
+		h.sendARP(layers.ARPReply, mac, sender)
+	}
+}
+
+func (h *Host) sendARP(op uint16, dst net.HardwareAddr, target net.IP) {
+	dstHw := dst
+	if op == layers.ARPRequest {
+		dstHw = make(net.HardwareAddr, 6)
+	}
+	h.send(&layers.Ethernet{
+		SrcMAC:       h.Mac,
+		DstMAC:       dst,
+		EthernetType: layers.EthernetTypeARP,
+	}, &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         op,
+		SourceHwAddress:   h.Mac,
+		SourceProtAddress: h.Addr(),
+		DstHwAddress:      dstHw,
+		DstProtAddress:    target.To4(),
+	})
+}
+
+// Broadcast a gratuitous ARP for our address.
+func (h *Host) Announce() {
+	addr := h.Addr()
+	if addr == nil {
+		return
+	}
+	h.send(&layers.Ethernet{
+		SrcMAC:       h.Mac,
+		DstMAC:       broadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}, &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   h.Mac,
+		SourceProtAddress: addr,
+		DstHwAddress:      make(net.HardwareAddr, 6),
+		DstProtAddress:    addr,
+	})
+}
+
+// MAC of <ip> from the ARP cache, asking with ARP requests for up to
+// <timeout> if it isn't cached.
+func (h *Host) Resolve(ip string, timeout time.Duration) (net.HardwareAddr, error) {
+	if mac := h.ARP(ip); mac != nil {
+		return mac, nil
+	}
+	target := net.ParseIP(ip).To4()
+	if target == nil {
+		return nil, errors.New("parsing ip")
+	}
+	h.sendARP(layers.ARPRequest, broadcast, target)
+	if !h.wait(timeout, func() bool { return h.arp[ip] != nil }) {
+		return nil, errors.New("no ARP reply from " + ip)
+	}
+	return h.ARP(ip), nil
+}
+
+// MAC to send to for <dst>: its own or the gateway's, see Resolve
+func (h *Host) nextHop(dst net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	if dst.Equal(net.IPv4bcast) {
+		return broadcast, nil
+	}
+	hop := dst
+	if !h.lan.Subnet.Contains(dst) {
+		h.lock.Lock()
+		hop = h.router
+		h.lock.Unlock()
+		if hop == nil {
+			if gw := h.lan.Gateway(); gw != nil {
+				hop = gw.Addr()
+			}
+		}
+		if hop == nil {
+			return nil, errors.New("no route to " + dst.String())
+		}
+	}
+	return h.Resolve(hop.String(), timeout)
+}
+
+// Send an ICMP echo request to <ip> (through whatever the ARP cache says)
+// and wait up to <timeout> for the reply.
+func (h *Host) Ping(ip string, timeout time.Duration) error {
+	dst := net.ParseIP(ip).To4()
+	if dst == nil {
+		return errors.New("parsing ip")
+	}
+	mac, err := h.nextHop(dst, timeout)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.echoID++
+	id := h.echoID
+	h.lock.Unlock()
+	h.sendIP(mac, dst, layers.IPProtocolICMPv4, &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       id,
+		Seq:      1,
+	})
+	if !h.wait(timeout, func() bool { return h.pongs[id] }) {
+		return errors.New("no echo reply from " + ip)
+	}
+	return nil
+}
+
+func (h *Host) handleICMP(eth *layers.Ethernet, ip4 *layers.IPv4, icmp *layers.ICMPv4) {
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoReply:
+		h.lock.Lock()
+		h.pongs[icmp.Id] = true
+		h.notify()
+		h.lock.Unlock()
+	case layers.ICMPv4TypeEchoRequest:
+		addr := h.Addr()
+		gateway := h.lan.Gateway() == h && !h.lan.Subnet.Contains(ip4.DstIP)
+		if addr == nil || !(addr.Equal(ip4.DstIP) || gateway) {
+			return
+		}
+		mac := h.ARP(ip4.SrcIP.String())
+		if mac == nil {
+			// can't wait for an ARP reply in here
+			mac = eth.SrcMAC
+		}
+		reply := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+			Id:       icmp.Id,
+			Seq:      icmp.Seq,
+		}
+		h.sendIPFrom(ip4.DstIP, mac, ip4.SrcIP, layers.IPProtocolICMPv4, reply,
+			gopacket.Payload(icmp.Payload))
+	}
+}
+
+func (h *Host) sendIP(mac net.HardwareAddr, dst net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) {
+	src := h.Addr()
+	if src == nil {
+		src = net.IPv4zero
+	}
+	h.sendIPFrom(src, mac, dst, proto, l...)
+}
+
+func (h *Host) sendIPFrom(src net.IP, mac net.HardwareAddr, dst net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) {
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	if len(l) > 0 {
+		if udp, ok := l[0].(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip4)
+		}
+	}
+	eth := &layers.Ethernet{SrcMAC: h.Mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}
+	h.send(append([]gopacket.SerializableLayer{eth, ip4}, l...)...)
+}
+
+func (h *Host) send(l ...gopacket.SerializableLayer) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return
+	}
+	h.port.WritePacketData(buf.Bytes())
+}
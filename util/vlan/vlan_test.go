@@ -0,0 +1,53 @@
+package vlan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLAN(t *testing.T) {
+	lan, err := New("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lan.Close()
+	gw, err := lan.AddGateway("gw", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.ServeDHCP("10.0.0.100", "10.0.0.110"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.ServeDNS(map[string]string{"gw.lan": "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := lan.AddHost("laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := laptop.RequestLease(time.Second)
+	if err != nil || addr.String() != "10.0.0.100" || !laptop.Router().Equal(gw.Addr()) {
+		t.Fatalf("lease %v via %v: %v", addr, laptop.Router(), err)
+	}
+	if err := laptop.Ping("10.0.0.1", time.Second); err != nil {
+		t.Error(err)
+	}
+	if !laptop.WaitARP("10.0.0.1", gw.Mac, time.Second) ||
+		!gw.WaitARP("10.0.0.100", laptop.Mac, time.Second) {
+		t.Errorf("ARP caches: %v %v", laptop.ARPCache(), gw.ARPCache())
+	}
+	// routed through the gateway
+	if err := laptop.Ping("192.0.2.1", time.Second); err != nil {
+		t.Error(err)
+	}
+	if ip, err := laptop.Lookup("10.0.0.1", "gw.lan", time.Second); err != nil || !ip.Equal(gw.Addr()) {
+		t.Errorf("lookup: %v %v", ip, err)
+	}
+	if _, err := laptop.Lookup("10.0.0.1", "nope.lan", time.Second); err == nil {
+		t.Error("lookup of unknown name")
+	}
+	if err := laptop.Ping("10.0.0.99", time.Millisecond*100); err == nil {
+		t.Error("ping of nobody")
+	}
+}